@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/node"
+	"github.com/dbkbali/blocker/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// runAdmin handles the admin subcommands, which talk to a local node:
+//
+//	admin [-node ADDR] [-insecure-devnet] peers
+//	admin [-node ADDR] [-insecure-devnet] ban [-duration D] [-reason R] TARGET
+//	admin [-node ADDR] [-insecure-devnet] unban TARGET
+func runAdmin(args []string) error {
+	var (
+		fs          = flag.NewFlagSet("admin", flag.ContinueOnError)
+		addr        = fs.String("node", ":3000", "address of the node")
+		insecureDev = fs.Bool("insecure-devnet", false, "connect without TLS to a node running insecure on devnet")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: admin <peers|ban|unban>")
+	}
+
+	var creds credentials.TransportCredentials = insecure.NewCredentials()
+	if !*insecureDev {
+		var err error
+		if creds, err = node.NewTransportCredentials(crypto.GeneratePrivateKey(), nil); err != nil {
+			return err
+		}
+	}
+	conn, err := grpc.Dial(*addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var (
+		client      = proto.NewAdminClient(conn)
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		cmdArgs     = fs.Args()[1:]
+	)
+	defer cancel()
+
+	switch fs.Arg(0) {
+	case "peers":
+		resp, err := client.ListPeers(ctx, &proto.ListPeersRequest{})
+		if err != nil {
+			return err
+		}
+		for _, p := range resp.Peers {
+			direction := "inbound"
+			if p.Outbound {
+				direction = "outbound"
+			}
+			fmt.Printf("%s %s %s height=%d score=%d\n", p.NodeId, p.ListenAddr, direction, p.Height, p.Score)
+		}
+		for _, ban := range resp.Bans {
+			fmt.Printf("banned %s until %s: %s\n", ban.Target, time.Unix(ban.Until, 0).Format(time.RFC3339), ban.Reason)
+		}
+		return nil
+	case "ban":
+		banFlags := flag.NewFlagSet("admin ban", flag.ContinueOnError)
+		duration := banFlags.Duration("duration", 0, "ban duration, the node default if zero")
+		reason := banFlags.String("reason", "", "reason of the ban")
+		if err := banFlags.Parse(cmdArgs); err != nil {
+			return err
+		}
+		if banFlags.NArg() != 1 {
+			return fmt.Errorf("usage: admin ban [-duration D] [-reason R] TARGET")
+		}
+		_, err := client.BanPeer(ctx, &proto.BanRequest{
+			Target:   banFlags.Arg(0),
+			Reason:   *reason,
+			Duration: int64(duration.Seconds()),
+		})
+		return err
+	case "unban":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: admin unban TARGET")
+		}
+		_, err := client.UnbanPeer(ctx, &proto.UnbanRequest{Target: cmdArgs[0]})
+		return err
+	default:
+		return fmt.Errorf("unknown admin command [%s]", fs.Arg(0))
+	}
+}
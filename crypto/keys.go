@@ -60,6 +60,11 @@ func (p *PrivateKey) Bytes() []byte {
 	return p.key
 }
 
+// Seed returns the 32 byte seed the key is derived from
+func (p *PrivateKey) Seed() []byte {
+	return p.key.Seed()
+}
+
 func (p *PrivateKey) Sign(msg []byte) *Signature {
 	return &Signature{value: ed25519.Sign(p.key, msg)}
 }
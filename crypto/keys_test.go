@@ -50,3 +50,10 @@ func TestPublicKeyAddress(t *testing.T) {
 
 	assert.Equal(t, AddressLen, len(address.Bytes()))
 }
+
+func TestPrivateKeySeed(t *testing.T) {
+	seed := "30df7d116d04af6b6869fd1407b37866f00c92359bc407290e1dfae6940afa34"
+	privKey := NewPrivateKeyFromString(seed)
+	assert.Equal(t, SeedLen, len(privKey.Seed()))
+	assert.Equal(t, privKey.Bytes(), NewPrivateKeyFromSeed(privKey.Seed()).Bytes())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dbkbali/blocker/node"
+)
+
+// listFlag collects the values of a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// runGenesis handles the genesis subcommands:
+//
+//	genesis init -chain-id ID -alloc ADDRESS=AMOUNT... -validator PUBKEY=STAKE... [-timestamp UNIX] [-out FILE]
+//	genesis hash FILE
+func runGenesis(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: genesis <init|hash>")
+	}
+
+	switch args[0] {
+	case "init":
+		return genesisInit(args[1:])
+	case "hash":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: genesis hash FILE")
+		}
+		genesis, err := node.LoadGenesis(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(hex.EncodeToString(genesis.Hash()))
+		return nil
+	default:
+		return fmt.Errorf("unknown genesis command [%s]", args[0])
+	}
+}
+
+func genesisInit(args []string) error {
+	var (
+		fs         = flag.NewFlagSet("genesis init", flag.ContinueOnError)
+		chainID    = fs.String("chain-id", "", "id of the new chain")
+		timestamp  = fs.Int64("timestamp", time.Now().Unix(), "genesis timestamp in unix seconds")
+		out        = fs.String("out", "genesis.json", "path of the genesis file to write")
+		allocs     listFlag
+		validators listFlag
+	)
+	fs.Var(&allocs, "alloc", "initial balance as ADDRESS=AMOUNT, can be repeated")
+	fs.Var(&validators, "validator", "initial validator as PUBKEY=STAKE, can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	genesis := &node.Genesis{
+		ChainID:   *chainID,
+		Timestamp: *timestamp,
+	}
+	for _, alloc := range allocs {
+		address, amount, err := parseAssignment(alloc)
+		if err != nil {
+			return fmt.Errorf("invalid alloc [%s]: %w", alloc, err)
+		}
+		genesis.Alloc = append(genesis.Alloc, node.GenesisAlloc{Address: address, Amount: amount})
+	}
+	for _, validator := range validators {
+		pubKey, stake, err := parseAssignment(validator)
+		if err != nil {
+			return fmt.Errorf("invalid validator [%s]: %w", validator, err)
+		}
+		genesis.Validators = append(genesis.Validators, node.GenesisValidator{PublicKey: pubKey, Stake: stake})
+	}
+	if err := genesis.Validate(); err != nil {
+		return err
+	}
+	if err := genesis.Save(*out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "wrote genesis of chain [%s] to [%s]\n", genesis.ChainID, *out)
+	fmt.Println(hex.EncodeToString(genesis.Hash()))
+	return nil
+}
+
+// parseAssignment splits a KEY=AMOUNT flag value
+func parseAssignment(s string) (string, int64, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", 0, fmt.Errorf("expected KEY=AMOUNT")
+	}
+	amount, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return key, amount, nil
+}
@@ -2,71 +2,230 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dbkbali/blocker/crypto"
 	"github.com/dbkbali/blocker/node"
 	"github.com/dbkbali/blocker/proto"
-	"github.com/dbkbali/blocker/util"
+	"github.com/dbkbali/blocker/types"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+const (
+	maxRetries = 3
+	retryDelay = 500 * time.Millisecond
+	// shutdownTimeout is how long the nodes get to stop gracefully
+	shutdownTimeout = 10 * time.Second
+)
+
 func main() {
-	makeNode(":3000", []string{}, true)
+	if len(os.Args) > 1 && os.Args[1] == "genesis" {
+		if err := runGenesis(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdmin(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var (
+		network     = flag.String("network", node.Devnet, "built-in network to join (mainnet, testnet, devnet)")
+		paramsFile  = flag.String("params", "", "path to a JSON file with custom chain params")
+		genesisFile = flag.String("genesis", "", "path to a genesis file replacing the genesis of the params")
+		keyDir      = flag.String("keydir", "keys", "directory keeping the persistent node identity keys, ephemeral keys if empty")
+		dataDir     = flag.String("datadir", "", "directory keeping the address books and ban lists of the nodes, in memory if empty")
+		insecureDev = flag.Bool("insecure-devnet", false, "disable TLS between nodes, only allowed on devnet")
+		queryAddr   = flag.String("query-addr", ":3100", "address the first node serves the query service on, not served if empty")
+		allowed     listFlag
+	)
+	flag.Var(&allowed, "allow-peer", "node id allowed to connect, can be repeated, any if not set")
+	flag.Parse()
+
+	params, err := loadParams(*network, *paramsFile, *genesisFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	transport := transportConfig{insecure: *insecureDev, allowedPeers: allowed}
+	dirs := nodeDirs{keys: *keyDir, data: *dataDir}
+	nodes := []*node.Node{}
+	nodes = append(nodes, makeNode(params, dirs, transport, ":3000", *queryAddr, []string{}, true))
 	time.Sleep(1 * time.Second)
-	makeNode(":4000", []string{":3000"}, false)
+	nodes = append(nodes, makeNode(params, dirs, transport, ":4000", "", []string{":3000"}, false))
 	time.Sleep(1 * time.Second)
-	makeNode(":3002", []string{":4000"}, false)
+	nodes = append(nodes, makeNode(params, dirs, transport, ":3002", "", []string{":4000"}, false))
+
+	creds, err := clientCredentials(*insecureDev)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
 	for {
-		time.Sleep(time.Second)
-		makeTransaction()
+		select {
+		case <-ctx.Done():
+			log.Printf("shutting down")
+			stopNodes(nodes)
+			return
+		case <-ticker.C:
+			makeTransaction(creds, params)
+		}
+	}
+}
+
+// stopNodes stops all nodes at once, giving them shutdownTimeout to finish
+func stopNodes(nodes []*node.Node) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *node.Node) {
+			defer wg.Done()
+			if err := n.Stop(ctx); err != nil {
+				log.Printf("stopping node failed: %v", err)
+			}
+		}(n)
+	}
+	wg.Wait()
+}
+
+func loadParams(network string, paramsFile string, genesisFile string) (*node.ChainParams, error) {
+	var (
+		params *node.ChainParams
+		err    error
+	)
+	if len(paramsFile) > 0 {
+		params, err = node.LoadChainParams(paramsFile)
+	} else {
+		params, err = node.ParamsForNetwork(network)
+	}
+	if err != nil {
+		return nil, err
 	}
 
+	if len(genesisFile) > 0 {
+		genesis, err := node.LoadGenesis(genesisFile)
+		if err != nil {
+			return nil, err
+		}
+		params.Genesis = *genesis
+	}
+	log.Printf("network [%s] chain [%s] genesis [%x]", params.Name, params.Genesis.ChainID, params.Genesis.Hash())
+	return params, nil
+}
+
+// nodeDirs holds the directories of the persistent node state
+type nodeDirs struct {
+	keys string
+	data string
 }
 
-func makeNode(listenAddr string, bootstrapNodes []string, isValidator bool) *node.Node {
+// transportConfig holds the transport security flags of the nodes
+type transportConfig struct {
+	insecure     bool
+	allowedPeers []string
+}
+
+func makeNode(params *node.ChainParams, dirs nodeDirs, transport transportConfig, listenAddr string, queryAddr string, bootstrapNodes []string, isValidator bool) *node.Node {
 	cfg := &node.ServerConfig{
-		Version:    "0.0.1",
-		ListenAddr: listenAddr,
+		Version:      "0.0.1",
+		ListenAddr:   listenAddr,
+		QueryAddr:    queryAddr,
+		Params:       params,
+		AllowedPeers: transport.allowedPeers,
+		Insecure:     transport.insecure,
+	}
+	name := "node" + strings.ReplaceAll(listenAddr, ":", "_")
+	if len(dirs.keys) > 0 {
+		nodeKey, err := node.LoadOrCreateNodeKey(filepath.Join(dirs.keys, name+".key"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.NodeKey = nodeKey
+	}
+	if len(dirs.data) > 0 {
+		cfg.AddrBookPath = filepath.Join(dirs.data, name+".addrbook.json")
+		cfg.BanListPath = filepath.Join(dirs.data, name+".bans.json")
 	}
 	if isValidator {
 		cfg.PrivateKey = crypto.GeneratePrivateKey()
 	}
 
 	n := node.NewNode(*cfg)
-	go n.Start(listenAddr, bootstrapNodes)
+	if err := n.Start(listenAddr, bootstrapNodes); err != nil {
+		log.Fatal(err)
+	}
 	return n
 }
 
-func makeTransaction() {
-	client, err := grpc.Dial(":3000", grpc.WithTransportCredentials(insecure.NewCredentials()))
+// clientCredentials returns the credentials used to submit transactions, the
+// nodes require a client certificate unless they run insecure.
+func clientCredentials(insecureDev bool) (credentials.TransportCredentials, error) {
+	if insecureDev {
+		return insecure.NewCredentials(), nil
+	}
+	return node.NewTransportCredentials(crypto.GeneratePrivateKey(), nil)
+}
+
+// makeTransaction submits a transaction spending the first genesis output to
+// a random address, which only the built-in genesis key can sign.
+func makeTransaction(creds credentials.TransportCredentials, params *node.ChainParams) {
+	client, err := grpc.Dial(":3000", grpc.WithTransportCredentials(creds))
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
+	defer client.Close()
 
-	c := proto.NewNodeClient(client)
-	privKey := crypto.GeneratePrivateKey()
+	var (
+		c       = proto.NewNodeClient(client)
+		privKey = node.GenesisKey()
+		genesis = params.Genesis.Block().Transactions[0]
+	)
 	tx := &proto.Transaction{
 		Version: 1,
 		Inputs: []*proto.TxInput{
 			{
-				PrevTxHash:   util.RandomHash(),
+				PrevTxHash:   types.HashTransaction(genesis),
 				PrevOutIndex: 0,
-				PublicKey:    privKey.Bytes(),
+				PublicKey:    privKey.Public().Bytes(),
 			},
 		},
 		Outputs: []*proto.TxOutput{
 			{
 				Amount:  99,
-				Address: privKey.Public().Address().Bytes(),
+				Address: crypto.GeneratePrivateKey().Public().Address().Bytes(),
 			},
 		}}
+	tx.Inputs[0].Signature = types.SignTransaction(privKey, tx).Bytes()
 
-	_, err = c.HandleTransaction(context.TODO(), tx)
+	for retries := 0; ; retries++ {
+		_, err = c.HandleTransaction(context.TODO(), tx)
+		if err == nil || !node.IsRetryable(err) || retries == maxRetries {
+			break
+		}
+		time.Sleep(time.Duration(retries+1) * retryDelay)
+	}
 	if err != nil {
-		log.Fatalf("Error when calling Handshake: %v", err)
+		log.Printf("Error when calling HandleTransaction: %v", err)
 	}
 }
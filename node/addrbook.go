@@ -0,0 +1,304 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// baseBackoff is the delay before redialing an address that failed once
+	baseBackoff = time.Second
+	// maxBackoff caps the delay between dials of a failing address
+	maxBackoff = 10 * time.Minute
+	// backoffJitter is the fraction by which a backoff is randomised
+	backoffJitter = 0.2
+	// maxAddrFailures is the number of failed dials after which an address is
+	// forgotten, unless it is a bootstrap node
+	maxAddrFailures = 10
+	// maxAddrsPerSource caps the addresses a single peer can add to the book,
+	// so one peer can not fill it with hosts of its choice
+	maxAddrsPerSource = 64
+)
+
+// KnownAddress is an address of a node we connected to or heard about
+type KnownAddress struct {
+	Addr   string `json:"addr"`
+	NodeID string `json:"nodeId,omitempty"`
+	// LastSeen is the last time we were connected to the node
+	LastSeen    time.Time `json:"lastSeen"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	// Failures counts the consecutive failed dials
+	Failures  int  `json:"failures"`
+	Bootstrap bool `json:"bootstrap,omitempty"`
+	// Source is the node id of the peer that told us about the address,
+	// empty for bootstrap nodes and nodes that connected to us
+	Source string `json:"source,omitempty"`
+}
+
+// AddrBook keeps the known addresses of the network. It is persisted to path
+// by Save, or only kept in memory if path is empty.
+type AddrBook struct {
+	lock  sync.RWMutex
+	path  string
+	addrs map[string]*KnownAddress
+	// bySource counts the addresses learned from each peer
+	bySource map[string]int
+	dirty    bool
+}
+
+// NewAddrBook loads the address book stored at path, which does not have to
+// exist yet.
+func NewAddrBook(path string) (*AddrBook, error) {
+	book := &AddrBook{
+		path:     path,
+		addrs:    make(map[string]*KnownAddress),
+		bySource: make(map[string]int),
+	}
+	if len(path) == 0 {
+		return book, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	addrs := []*KnownAddress{}
+	if err := json.Unmarshal(b, &addrs); err != nil {
+		return nil, fmt.Errorf("invalid address book [%s]: %w", path, err)
+	}
+	for _, addr := range addrs {
+		book.addrs[addr.Addr] = addr
+		book.bySource[addr.Source]++
+	}
+	return book, nil
+}
+
+// Add adds addr to the book and reports whether it was unknown
+func (b *AddrBook) Add(addr string, bootstrap bool) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if known, ok := b.addrs[addr]; ok {
+		if bootstrap && !known.Bootstrap {
+			known.Bootstrap = true
+			b.dirty = true
+		}
+		return false
+	}
+	b.add(&KnownAddress{
+		Addr:      addr,
+		Bootstrap: bootstrap,
+	})
+	return true
+}
+
+// AddFrom adds addr learned from the peer source and reports whether it was
+// added. Addresses beyond maxAddrsPerSource of a peer are dropped.
+func (b *AddrBook) AddFrom(addr string, source string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.addrs[addr]; ok {
+		return false
+	}
+	if b.bySource[source] >= maxAddrsPerSource {
+		return false
+	}
+	b.add(&KnownAddress{
+		Addr:   addr,
+		Source: source,
+	})
+	return true
+}
+
+func (b *AddrBook) add(known *KnownAddress) {
+	b.addrs[known.Addr] = known
+	b.bySource[known.Source]++
+	b.dirty = true
+}
+
+// Good records a successful connection to the node with nodeID at addr
+func (b *AddrBook) Good(addr string, nodeID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	known, ok := b.addrs[addr]
+	if !ok {
+		known = &KnownAddress{Addr: addr}
+		b.add(known)
+	}
+	now := time.Now()
+	known.NodeID = nodeID
+	known.LastSeen = now
+	known.LastAttempt = now
+	known.NextAttempt = time.Time{}
+	known.Failures = 0
+	b.dirty = true
+}
+
+// Failed records a failed dial of addr and schedules the next attempt with
+// exponential backoff.
+func (b *AddrBook) Failed(addr string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	known, ok := b.addrs[addr]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	known.Failures++
+	known.LastAttempt = now
+	known.NextAttempt = now.Add(backoff(known.Failures))
+	if known.Failures > maxAddrFailures && !known.Bootstrap {
+		delete(b.addrs, addr)
+		b.bySource[known.Source]--
+	}
+	b.dirty = true
+}
+
+// Get returns a copy of the known address addr
+func (b *AddrBook) Get(addr string) (KnownAddress, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	known, ok := b.addrs[addr]
+	if !ok {
+		return KnownAddress{}, false
+	}
+	return *known, true
+}
+
+func (b *AddrBook) Len() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return len(b.addrs)
+}
+
+// DialCandidates returns up to max addresses whose backoff has elapsed at
+// now and for which skip returns false. The addresses are drawn in rounds
+// taking one of every source in random order, so a peer that told us about
+// many addresses is not dialed more often than others. Of each source the
+// least failing addresses are drawn first.
+func (b *AddrBook) DialCandidates(now time.Time, max int, skip func(addr string) bool) []string {
+	// the eligible addresses are copied, as skip may call back into the book
+	b.lock.RLock()
+	eligible := []KnownAddress{}
+	for _, known := range b.addrs {
+		if !now.Before(known.NextAttempt) {
+			eligible = append(eligible, *known)
+		}
+	}
+	b.lock.RUnlock()
+
+	bySource := map[string][]*KnownAddress{}
+	for i := range eligible {
+		known := &eligible[i]
+		if skip(known.Addr) {
+			continue
+		}
+		bySource[known.Source] = append(bySource[known.Source], known)
+	}
+
+	sources := make([][]*KnownAddress, 0, len(bySource))
+	for _, candidates := range bySource {
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Failures < candidates[j].Failures
+		})
+		sources = append(sources, candidates)
+	}
+
+	rand.Shuffle(len(sources), func(i, j int) {
+		sources[i], sources[j] = sources[j], sources[i]
+	})
+
+	addrs := []string{}
+	for len(sources) > 0 {
+		remaining := sources[:0]
+		for _, candidates := range sources {
+			if len(addrs) == max {
+				return addrs
+			}
+			addrs = append(addrs, candidates[0].Addr)
+			if len(candidates) > 1 {
+				remaining = append(remaining, candidates[1:])
+			}
+		}
+		sources = remaining
+	}
+	return addrs
+}
+
+// Sample returns up to max random addresses that did not fail their last dial
+func (b *AddrBook) Sample(max int) []string {
+	b.lock.RLock()
+	addrs := []string{}
+	for _, known := range b.addrs {
+		if known.Failures == 0 {
+			addrs = append(addrs, known.Addr)
+		}
+	}
+	b.lock.RUnlock()
+
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	return addrs[:min(len(addrs), max)]
+}
+
+// Save persists the book if it changed since the last save
+func (b *AddrBook) Save() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.path) == 0 || !b.dirty {
+		return nil
+	}
+	addrs := make([]*KnownAddress, 0, len(b.addrs))
+	for _, known := range b.addrs {
+		addrs = append(addrs, known)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Addr < addrs[j].Addr
+	})
+	data, err := json.MarshalIndent(addrs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a torn book
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+// backoff returns the randomised delay before the next dial of an address
+// that failed the given number of times in a row.
+func backoff(failures int) time.Duration {
+	delay := maxBackoff
+	if failures <= 30 {
+		delay = min(baseBackoff<<(failures-1), maxBackoff)
+	}
+	jitter := (rand.Float64()*2 - 1) * backoffJitter * float64(delay)
+	return delay + time.Duration(jitter)
+}
@@ -0,0 +1,166 @@
+package node
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddrBookPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addrbook.json")
+	book, err := NewAddrBook(path)
+	require.Nil(t, err)
+
+	assert.True(t, book.Add(":3000", true))
+	assert.False(t, book.Add(":3000", false))
+	assert.True(t, book.Add(":4000", false))
+	book.Good(":4000", "node")
+	book.Failed(":3000")
+	require.Nil(t, book.Save())
+
+	book, err = NewAddrBook(path)
+	require.Nil(t, err)
+	assert.Equal(t, 2, book.Len())
+	known, ok := book.Get(":3000")
+	require.True(t, ok)
+	assert.True(t, known.Bootstrap)
+	assert.Equal(t, 1, known.Failures)
+	known, ok = book.Get(":4000")
+	require.True(t, ok)
+	assert.Equal(t, "node", known.NodeID)
+	assert.False(t, known.LastSeen.IsZero())
+}
+
+func TestAddrBookBackoff(t *testing.T) {
+	book, err := NewAddrBook("")
+	require.Nil(t, err)
+	book.Add(":3000", false)
+	book.Add(":4000", true)
+
+	skipNone := func(string) bool { return false }
+	assert.Equal(t, 2, len(book.DialCandidates(time.Now(), 10, skipNone)))
+	assert.Equal(t, 1, len(book.DialCandidates(time.Now(), 1, skipNone)))
+
+	book.Failed(":3000")
+	book.Failed(":3000")
+	known, _ := book.Get(":3000")
+	delay := known.NextAttempt.Sub(known.LastAttempt)
+	assert.GreaterOrEqual(t, delay, time.Duration(float64(2*baseBackoff)*(1-backoffJitter)))
+	assert.LessOrEqual(t, delay, time.Duration(float64(2*baseBackoff)*(1+backoffJitter)))
+
+	assert.Equal(t, []string{":4000"}, book.DialCandidates(time.Now(), 10, skipNone))
+	assert.Equal(t, 2, len(book.DialCandidates(known.NextAttempt, 10, skipNone)))
+	assert.Empty(t, book.DialCandidates(known.NextAttempt, 10, func(string) bool { return true }))
+
+	// failing addresses are forgotten, bootstrap nodes are kept
+	for i := 0; i < maxAddrFailures; i++ {
+		book.Failed(":3000")
+		book.Failed(":4000")
+	}
+	_, ok := book.Get(":3000")
+	assert.False(t, ok)
+	known, ok = book.Get(":4000")
+	assert.True(t, ok)
+	assert.LessOrEqual(t, known.NextAttempt.Sub(known.LastAttempt), time.Duration(float64(maxBackoff)*(1+backoffJitter)))
+}
+
+func TestAddrBookSourceCap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addrbook.json")
+	book, err := NewAddrBook(path)
+	require.Nil(t, err)
+
+	for i := 0; i < maxAddrsPerSource; i++ {
+		assert.True(t, book.AddFrom(fmt.Sprintf(":%d", 10000+i), "spammer"))
+	}
+	assert.False(t, book.AddFrom(":9999", "spammer"))
+	assert.False(t, book.AddFrom(":10000", "other"))
+	assert.True(t, book.AddFrom(":9999", "other"))
+	require.Nil(t, book.Save())
+
+	// the cap survives a restart, forgotten addresses free their slot
+	book, err = NewAddrBook(path)
+	require.Nil(t, err)
+	known, _ := book.Get(":10000")
+	assert.Equal(t, "spammer", known.Source)
+	assert.False(t, book.AddFrom(":9998", "spammer"))
+	for i := 0; i <= maxAddrFailures; i++ {
+		book.Failed(":10000")
+	}
+	assert.True(t, book.AddFrom(":9998", "spammer"))
+}
+
+func TestDialCandidatesBySource(t *testing.T) {
+	book, err := NewAddrBook("")
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		book.AddFrom(fmt.Sprintf(":%d", 10000+i), "spammer")
+	}
+	book.AddFrom(":4000", "peer")
+	book.Add(":3000", true)
+
+	// every source is drawn from before any is drawn from twice
+	addrs := book.DialCandidates(time.Now(), 3, func(string) bool { return false })
+	assert.Equal(t, 3, len(addrs))
+	assert.Contains(t, addrs, ":3000")
+	assert.Contains(t, addrs, ":4000")
+	assert.Equal(t, 12, len(book.DialCandidates(time.Now(), 20, func(string) bool { return false })))
+}
+
+func TestDialCandidatesConcurrentWrites(t *testing.T) {
+	book, err := NewAddrBook("")
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		book.AddFrom(fmt.Sprintf("10.0.0.%d:3000", i), "peer")
+	}
+
+	stop := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			addr := fmt.Sprintf("10.0.0.%d:3000", i%10)
+			book.AddFrom(addr, "other")
+			book.Failed(addr)
+		}
+	}()
+
+	// skip reads the book like the connect loop does
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			book.DialCandidates(time.Now().Add(time.Hour), 5, func(addr string) bool {
+				_, ok := book.Get(addr)
+				return !ok
+			})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("DialCandidates deadlocked")
+	}
+	close(stop)
+	<-written
+}
+
+func TestSample(t *testing.T) {
+	book, err := NewAddrBook("")
+	require.Nil(t, err)
+	book.Add(":3000", false)
+	book.Add(":4000", false)
+	book.Add(":5000", false)
+	book.Failed(":5000")
+
+	assert.ElementsMatch(t, []string{":3000", ":4000"}, book.Sample(10))
+	assert.Equal(t, 1, len(book.Sample(1)))
+}
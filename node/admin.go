@@ -0,0 +1,106 @@
+package node
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dbkbali/blocker/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func (n *Node) ListPeers(ctx context.Context, req *proto.ListPeersRequest) (*proto.ListPeersResponse, error) {
+	resp := &proto.ListPeersResponse{}
+	for nodeID, p := range n.getPeers() {
+		resp.Peers = append(resp.Peers, &proto.PeerInfo{
+			NodeId:     nodeID,
+			ListenAddr: p.handshake.ListenAddr,
+			RemoteAddr: p.remoteAddr,
+			Outbound:   p.outbound,
+			Height:     p.handshake.Height,
+			Score:      int32(n.score(nodeID)),
+		})
+	}
+	sort.Slice(resp.Peers, func(i, j int) bool {
+		return resp.Peers[i].NodeId < resp.Peers[j].NodeId
+	})
+	for _, ban := range n.banList.List() {
+		resp.Bans = append(resp.Bans, &proto.BanInfo{
+			Target: ban.Target,
+			Reason: ban.Reason,
+			Until:  ban.Until.Unix(),
+		})
+	}
+	return resp, nil
+}
+
+func (n *Node) BanPeer(ctx context.Context, req *proto.BanRequest) (*proto.Ack, error) {
+	if len(req.Target) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing ban target")
+	}
+	if req.Duration < 0 {
+		return nil, status.Error(codes.InvalidArgument, "negative ban duration")
+	}
+	duration := defaultBanDuration
+	if req.Duration > 0 {
+		duration = time.Duration(req.Duration) * time.Second
+	}
+	reason := req.Reason
+	if len(reason) == 0 {
+		reason = "banned by admin"
+	}
+	if err := n.banPeer(req.Target, reason, duration); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &proto.Ack{}, nil
+}
+
+func (n *Node) UnbanPeer(ctx context.Context, req *proto.UnbanRequest) (*proto.Ack, error) {
+	ok, err := n.banList.Unban(req.Target)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "[%s] is not banned", req.Target)
+	}
+	n.logger.Infow("unbanned peer", "we", n.ListenAddr, "target", req.Target)
+	return &proto.Ack{}, nil
+}
+
+// accessInterceptor refuses calls of banned peers and admin calls that do
+// not come from the loopback interface.
+func (n *Node) accessInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := n.checkAccess(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamAccessInterceptor applies the checks of accessInterceptor to streams
+func (n *Node) streamAccessInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := n.checkAccess(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (n *Node) checkAccess(ctx context.Context, method string) error {
+	p, _ := peer.FromContext(ctx)
+	nodeID, host := peerTargets(p)
+
+	if strings.HasPrefix(method, "/Admin/") {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return status.Error(codes.PermissionDenied, "admin calls are only allowed from loopback")
+		}
+		return nil
+	}
+	if n.banList.IsBanned(nodeID, host) {
+		return reject(RejectBanned, "peer is banned")
+	}
+	return nil
+}
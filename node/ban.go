@@ -0,0 +1,335 @@
+package node
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// banThreshold is the misbehaviour score at which a peer is banned
+	banThreshold = 100
+	// defaultBanDuration is how long a misbehaving peer stays banned
+	defaultBanDuration = 24 * time.Hour
+	// scoreDecayInterval is how long it takes for a misbehaviour score to
+	// drop by one
+	scoreDecayInterval = time.Minute
+	// maxScores caps the number of peers a score is kept for
+	maxScores = 10_000
+)
+
+// misbehaviourScores are added to the score of a peer for data it sent that
+// was rejected with the given code.
+var misbehaviourScores = map[RejectCode]int{
+	RejectMalformed:         20,
+	RejectInsufficientFunds: 20,
+	RejectInvalidSignature:  50,
+	RejectInvalidHeader:     50,
+	RejectUnauthorized:      50,
+}
+
+// Ban keeps a peer from connecting until it expires. Target is the node id
+// of the peer, or its host when it did not identify with a certificate.
+type Ban struct {
+	Target string    `json:"target"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// BanList holds the active bans, which are persisted to path or only kept
+// in memory if path is empty.
+type BanList struct {
+	lock sync.RWMutex
+	path string
+	bans map[string]*Ban
+}
+
+// NewBanList loads the bans stored at path, which does not have to exist yet
+func NewBanList(path string) (*BanList, error) {
+	list := &BanList{
+		path: path,
+		bans: make(map[string]*Ban),
+	}
+	if len(path) == 0 {
+		return list, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	bans := []*Ban{}
+	if err := json.Unmarshal(b, &bans); err != nil {
+		return nil, fmt.Errorf("invalid ban list [%s]: %w", path, err)
+	}
+	for _, ban := range bans {
+		list.bans[ban.Target] = ban
+	}
+	return list, nil
+}
+
+// Ban bans target for duration and persists the list
+func (l *BanList) Ban(target string, reason string, duration time.Duration) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.bans[target] = &Ban{
+		Target: target,
+		Reason: reason,
+		Until:  time.Now().Add(duration),
+	}
+	return l.save()
+}
+
+// Unban lifts the ban of target and reports whether it was banned
+func (l *BanList) Unban(target string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.bans[target]; !ok {
+		return false, nil
+	}
+	delete(l.bans, target)
+	return true, l.save()
+}
+
+// IsBanned reports whether any of targets is banned
+func (l *BanList) IsBanned(targets ...string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	now := time.Now()
+	for _, target := range targets {
+		if len(target) == 0 {
+			continue
+		}
+		if ban, ok := l.bans[target]; ok && now.Before(ban.Until) {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the active bans ordered by target
+func (l *BanList) List() []Ban {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	var (
+		now  = time.Now()
+		bans = []Ban{}
+	)
+	for _, ban := range l.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Target < bans[j].Target
+	})
+	return bans
+}
+
+// save persists the bans that did not expire yet, the caller holds the lock
+func (l *BanList) save() error {
+	if len(l.path) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	bans := []*Ban{}
+	for target, ban := range l.bans {
+		if !now.Before(ban.Until) {
+			delete(l.bans, target)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Target < bans[j].Target
+	})
+	b, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// peerTargets returns the node id of the peer if it presented a certificate
+// and its host, which are the targets its bans and scores are kept under.
+func peerTargets(p *peer.Peer) (nodeID string, host string) {
+	nodeID, _ = tlsNodeID(p)
+	if p == nil || p.Addr == nil {
+		return nodeID, ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	return nodeID, host
+}
+
+// scoreTarget returns the target the misbehaviour of p is counted for
+func scoreTarget(p *peer.Peer) string {
+	nodeID, host := peerTargets(p)
+	if len(nodeID) > 0 {
+		return nodeID
+	}
+	return host
+}
+
+// Scores keeps the misbehaviour scores of peers, which decay over time. Once
+// maxScores peers are scored the least recently scored one is forgotten.
+type Scores struct {
+	lock sync.Mutex
+	// queue holds the scores in the order they were last raised
+	queue   *list.List
+	targets map[string]*list.Element
+}
+
+type peerScore struct {
+	target  string
+	score   int
+	updated time.Time
+}
+
+func NewScores() *Scores {
+	return &Scores{
+		queue:   list.New(),
+		targets: make(map[string]*list.Element),
+	}
+}
+
+// Add raises the score of target by score and returns its new score
+func (s *Scores) Add(target string, score int) int {
+	return s.add(target, score, time.Now())
+}
+
+func (s *Scores) add(target string, score int, now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	total := score
+	if elem, ok := s.targets[target]; ok {
+		total += s.queue.Remove(elem).(*peerScore).decayed(now)
+		delete(s.targets, target)
+	}
+	// the front holds the scores which had the longest time to decay
+	for s.queue.Len() > 0 {
+		front := s.queue.Front()
+		if s.queue.Len() < maxScores && front.Value.(*peerScore).decayed(now) > 0 {
+			break
+		}
+		s.remove(front)
+	}
+	s.targets[target] = s.queue.PushBack(&peerScore{target: target, score: total, updated: now})
+	return total
+}
+
+// Get returns the current score of target
+func (s *Scores) Get(target string) int {
+	return s.get(target, time.Now())
+}
+
+func (s *Scores) get(target string, now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	elem, ok := s.targets[target]
+	if !ok {
+		return 0
+	}
+	return elem.Value.(*peerScore).decayed(now)
+}
+
+// Reset forgets the score of target
+func (s *Scores) Reset(target string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if elem, ok := s.targets[target]; ok {
+		s.remove(elem)
+	}
+}
+
+func (s *Scores) remove(elem *list.Element) {
+	delete(s.targets, s.queue.Remove(elem).(*peerScore).target)
+}
+
+// decayed returns the score left at now
+func (p *peerScore) decayed(now time.Time) int {
+	score := p.score - int(now.Sub(p.updated)/scoreDecayInterval)
+	if score < 0 {
+		return 0
+	}
+	return score
+}
+
+// misbehaved adds the score of code to target and bans it once the score
+// reaches banThreshold.
+func (n *Node) misbehaved(target string, code RejectCode) {
+	score, ok := misbehaviourScores[code]
+	if !ok {
+		return
+	}
+	if len(target) == 0 {
+		return
+	}
+
+	total := n.scores.Add(target, score)
+	if total < banThreshold {
+		return
+	}
+	n.scores.Reset(target)
+	if err := n.banPeer(target, fmt.Sprintf("misbehaviour score %d", total), defaultBanDuration); err != nil {
+		n.logger.Errorw("banning peer failed", "target", target, "err", err)
+	}
+}
+
+// score returns the misbehaviour score counted for target
+func (n *Node) score(target string) int {
+	return n.scores.Get(target)
+}
+
+// banPeer bans target, which is a node id or host, and disconnects the peers
+// it matches.
+func (n *Node) banPeer(target string, reason string, duration time.Duration) error {
+	if err := n.banList.Ban(target, reason, duration); err != nil {
+		return err
+	}
+	n.logger.Infow("banned peer", "we", n.ListenAddr, "target", target, "reason", reason, "duration", duration)
+
+	for nodeID, p := range n.getPeers() {
+		host, _, _ := net.SplitHostPort(p.remoteAddr)
+		if nodeID == target || host == target {
+			n.deletePeer(nodeID, p, "banned")
+		}
+	}
+	return nil
+}
+
+// isBannedAddr reports whether dialing addr would reach a banned peer
+func (n *Node) isBannedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	known, _ := n.addrBook.Get(addr)
+	return n.banList.IsBanned(known.NodeID, host)
+}
@@ -0,0 +1,156 @@
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestBanListPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	list, err := NewBanList(path)
+	require.Nil(t, err)
+
+	require.Nil(t, list.Ban("node", "test", time.Hour))
+	require.Nil(t, list.Ban("expired", "test", -time.Second))
+	assert.True(t, list.IsBanned("other", "node"))
+	assert.False(t, list.IsBanned("expired", ""))
+
+	list, err = NewBanList(path)
+	require.Nil(t, err)
+	bans := list.List()
+	require.Equal(t, 1, len(bans))
+	assert.Equal(t, "node", bans[0].Target)
+	assert.Equal(t, "test", bans[0].Reason)
+
+	ok, err := list.Unban("node")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = list.Unban("node")
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	list, err = NewBanList(path)
+	require.Nil(t, err)
+	assert.Empty(t, list.List())
+}
+
+func TestMisbehavingCodesAreScored(t *testing.T) {
+	for code := range rejectCodeNames {
+		_, scored := misbehaviourScores[code]
+		assert.Equal(t, code.Misbehaving(), scored, code.String())
+	}
+}
+
+func TestMisbehaviourBansPeer(t *testing.T) {
+	var (
+		n       = newTestNode(t, ServerConfig{Params: &DevnetParams})
+		peerKey = crypto.GeneratePrivateKey()
+		nodeID  = NodeID(peerKey.Public())
+	)
+	conn, err := n.dialNode(freeAddr(t))
+	require.Nil(t, err)
+	n.peers[nodeID] = newRemotePeer(conn, &proto.HandshakeRequest{NodeId: nodeID})
+
+	// an insecure connection is scored by host
+	n.misbehaved(scoreTarget(&peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 3000}}), RejectMalformed)
+	assert.Equal(t, misbehaviourScores[RejectMalformed], n.score("10.0.0.1"))
+
+	cert, err := NewTLSCertificate(peerKey)
+	require.Nil(t, err)
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	require.Nil(t, err)
+	p := &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 3000},
+		AuthInfo: credentials.TLSInfo{
+			State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{x509Cert}},
+		},
+	}
+
+	// an authenticated peer is scored by node id and banned at the threshold
+	n.misbehaved(scoreTarget(p), RejectInvalidSignature)
+	assert.Equal(t, misbehaviourScores[RejectInvalidSignature], n.score(nodeID))
+	assert.False(t, n.banList.IsBanned(nodeID))
+	n.misbehaved(scoreTarget(p), RejectInvalidSignature)
+	assert.True(t, n.banList.IsBanned(nodeID))
+	assert.Equal(t, 0, n.score(nodeID))
+	assert.Empty(t, n.getPeers())
+}
+
+func TestScoresDecay(t *testing.T) {
+	var (
+		scores = NewScores()
+		now    = time.Now()
+	)
+	assert.Equal(t, 50, scores.add("10.0.0.1", 50, now))
+	assert.Equal(t, 40, scores.get("10.0.0.1", now.Add(10*scoreDecayInterval)))
+	assert.Equal(t, 60, scores.add("10.0.0.1", 20, now.Add(10*scoreDecayInterval)))
+	assert.Equal(t, 0, scores.get("10.0.0.1", now.Add(100*scoreDecayInterval)))
+
+	// fully decayed scores are forgotten
+	scores.add("10.0.0.2", 1, now.Add(100*scoreDecayInterval))
+	assert.Len(t, scores.targets, 1)
+}
+
+func TestScoresLimit(t *testing.T) {
+	var (
+		scores = NewScores()
+		now    = time.Now()
+	)
+	for i := 0; i < maxScores+1; i++ {
+		scores.add(fmt.Sprintf("node-%d", i), 50, now)
+	}
+	assert.Len(t, scores.targets, maxScores)
+	// the least recently scored peer is forgotten first
+	assert.Equal(t, 0, scores.get("node-0", now))
+	assert.Equal(t, 50, scores.get("node-1", now))
+}
+
+func TestAdminBanPeer(t *testing.T) {
+	var (
+		a = makeTestNode(t, &DevnetParams)
+		b = newTestNode(t, ServerConfig{Params: &DevnetParams})
+	)
+	conn, err := grpc.Dial(a.ListenAddr, grpc.WithTransportCredentials(b.creds))
+	require.Nil(t, err)
+	defer conn.Close()
+	admin := proto.NewAdminClient(conn)
+
+	_, err = admin.BanPeer(context.Background(), &proto.BanRequest{Target: b.nodeID, Reason: "test"})
+	require.Nil(t, err)
+	resp, err := admin.ListPeers(context.Background(), &proto.ListPeersRequest{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(resp.Bans))
+	assert.Equal(t, b.nodeID, resp.Bans[0].Target)
+
+	// the banned node is refused, but can still be unbanned from loopback
+	_, _, err = b.dialRemoteNode(a.ListenAddr)
+	assert.Equal(t, RejectBanned, RejectCodeOf(err))
+	_, err = proto.NewNodeClient(conn).HandleTransaction(context.Background(), randomTx())
+	assert.Equal(t, RejectBanned, RejectCodeOf(err))
+
+	_, err = admin.UnbanPeer(context.Background(), &proto.UnbanRequest{Target: b.nodeID})
+	require.Nil(t, err)
+	_, err = admin.UnbanPeer(context.Background(), &proto.UnbanRequest{Target: b.nodeID})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, _, err = b.dialRemoteNode(a.ListenAddr)
+	assert.Nil(t, err)
+
+	_, err = admin.BanPeer(context.Background(), &proto.BanRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
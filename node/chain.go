@@ -2,16 +2,25 @@ package node
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/dbkbali/blocker/crypto"
 	"github.com/dbkbali/blocker/proto"
 	"github.com/dbkbali/blocker/types"
+	pb "github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 const initSeed = "b927acba1ee5ebaf030af1a6ac2eb63922942ea39997ad7b2a23754cab1795d3"
 
+// blockVersion is the only block version currently supported
+const blockVersion = 1
+
 type HeaderList struct {
 	headers []*proto.Header
 }
@@ -27,7 +36,7 @@ func (h *HeaderList) Add(header *proto.Header) {
 }
 
 func (h *HeaderList) Get(index int) *proto.Header {
-	if index < h.Height() {
+	if index < 0 || index > h.Height() {
 		panic("index out of range")
 	}
 	return h.headers[index]
@@ -38,6 +47,11 @@ func (h *HeaderList) Height() int {
 	return len(h.headers) - 1
 }
 
+// RemoveLast removes the header at Height
+func (h *HeaderList) RemoveLast() {
+	h.headers = h.headers[:len(h.headers)-1]
+}
+
 func (h *HeaderList) Len() int {
 	return len(h.headers)
 }
@@ -47,53 +61,92 @@ type UTXO struct {
 	OutIndex int
 	Amount   int64
 	Spent    bool
+	// Height of the block that created this output, used for relative timelocks
+	Height  int
+	Address []byte
+	HTLC    *proto.HTLC
+	// AssetID of the asset held by this output, empty for the native coin
+	AssetID []byte
 }
 
+// Chain is safe for concurrent use, blocks are added one at a time
 type Chain struct {
+	// lock guards the headers and the utxo set against concurrent blocks
+	lock       sync.RWMutex
+	params     *ChainParams
 	txStore    TXStorer
 	blockStore BlockStorer
 	headers    *HeaderList
 	utxoStore  UTXOStorer
+	dataIndex  DataIndexer
+	// assets maps the id of every issued asset to the issuing transaction
+	assets map[string]string
+	// addrIndex is only maintained if set with SetAddressIndex
+	addrIndex AddressIndexer
 }
 
-func NewChain(bs BlockStorer, txStore TXStorer) *Chain {
+func NewChain(params *ChainParams, bs BlockStorer, txStore TXStorer) *Chain {
 	chain := &Chain{
+		params:     params,
 		txStore:    txStore,
 		blockStore: bs,
 		utxoStore:  NewMemoryUTXOStore(),
+		dataIndex:  NewMemoryDataIndex(),
 		headers:    NewHeaderList(),
+		assets:     map[string]string{},
 	}
-	chain.addBlock(chain.createGenesisBlock())
+	chain.addBlock(params.Genesis.Block())
 	return chain
 }
 
 func (c *Chain) Height() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	return c.headers.Height()
 }
 
 func (c *Chain) AddBlock(b *proto.Block) error {
-	if err := c.ValidateBlock(b); err != nil {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := c.validateBlock(b); err != nil {
 		return err
 	}
 
 	return c.addBlock(b)
-} // Add header to header li}
+}
 
 func (c *Chain) addBlock(b *proto.Block) error {
 	c.headers.Add(b.Header)
+	height := c.headers.Height()
 
 	for _, tx := range b.Transactions {
 		if err := c.txStore.Put(tx); err != nil {
 			return err
 		}
 		hash := hex.EncodeToString(types.HashTransaction(tx))
+		if issuance := tx.Issuance; issuance != nil {
+			c.assets[hex.EncodeToString(types.AssetID(issuance.PublicKey, issuance.Name))] = hash
+		}
 
 		for i, output := range tx.Outputs {
+			// data outputs are unspendable and never enter the utxo set
+			if types.IsDataOutput(output) {
+				if err := c.dataIndex.Put(output.Data, hash); err != nil {
+					return err
+				}
+				continue
+			}
 			utxo := &UTXO{
 				Hash:     hash,
 				OutIndex: i,
 				Amount:   output.Amount,
 				Spent:    false,
+				Height:   height,
+				Address:  output.Address,
+				HTLC:     output.Htlc,
+				AssetID:  output.AssetId,
 			}
 			if err := c.utxoStore.Put(utxo); err != nil {
 				return err
@@ -112,18 +165,221 @@ func (c *Chain) addBlock(b *proto.Block) error {
 			}
 		}
 
+		if c.addrIndex != nil {
+			if err := c.indexTransaction(tx, hash, height); err != nil {
+				return err
+			}
+		}
 	}
 
 	return c.blockStore.Put(b)
 }
 
+// DisconnectTip removes the last block and its transactions from the chain
+// and the stores, restoring the outputs it spent.
+func (c *Chain) DisconnectTip() (*proto.Block, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	height := c.headers.Height()
+	if height == 0 {
+		return nil, fmt.Errorf("cannot disconnect the genesis block")
+	}
+	b, err := c.getBlockByHeight(height)
+	if err != nil {
+		return nil, err
+	}
+	// later transactions may spend outputs of earlier ones of the block
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		if err := c.disconnectTransaction(b.Transactions[i]); err != nil {
+			return nil, err
+		}
+	}
+	c.headers.RemoveLast()
+	if err := c.blockStore.Delete(hex.EncodeToString(types.HashBlock(b))); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *Chain) disconnectTransaction(tx *proto.Transaction) error {
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	// the spent outputs are still marked spent, which unindexTransaction
+	// relies on to find the addresses of the inputs
+	if c.addrIndex != nil {
+		if err := c.unindexTransaction(tx, hash); err != nil {
+			return err
+		}
+	}
+	if issuance := tx.Issuance; issuance != nil {
+		delete(c.assets, hex.EncodeToString(types.AssetID(issuance.PublicKey, issuance.Name)))
+	}
+	if err := c.txStore.Delete(hash); err != nil {
+		return err
+	}
+
+	for _, input := range tx.Inputs {
+		key := fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+		utxo, err := c.utxoStore.Get(key)
+		if err != nil {
+			return err
+		}
+		utxo.Spent = false
+		if err := c.utxoStore.Put(utxo); err != nil {
+			return err
+		}
+	}
+
+	for i, output := range tx.Outputs {
+		if types.IsDataOutput(output) {
+			if err := c.dataIndex.Delete(output.Data, hash); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.utxoStore.Delete(fmt.Sprintf("%s_%d", hash, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetAddressIndex makes the chain maintain idx, which is first filled with
+// the blocks already in the chain.
+func (c *Chain) SetAddressIndex(idx AddressIndexer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.addrIndex = idx
+	for height := 0; height <= c.headers.Height(); height++ {
+		if err := c.indexBlock(height); err != nil {
+			c.addrIndex = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Chain) indexBlock(height int) error {
+	b, err := c.getBlockByHeight(height)
+	if err != nil {
+		return err
+	}
+	for _, tx := range b.Transactions {
+		if err := c.indexTransaction(tx, hex.EncodeToString(types.HashTransaction(tx)), height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexTransaction adds the outputs of tx to the address index and records
+// tx for every address it pays to or spends from.
+func (c *Chain) indexTransaction(tx *proto.Transaction, hash string, height int) error {
+	addresses, err := c.transactionAddresses(tx)
+	if err != nil {
+		return err
+	}
+	for i, output := range tx.Outputs {
+		if types.IsDataOutput(output) {
+			continue
+		}
+		if err := c.addrIndex.AddOutput(output.Address, fmt.Sprintf("%s_%d", hash, i)); err != nil {
+			return err
+		}
+	}
+	for _, address := range addresses {
+		if err := c.addrIndex.AddTransaction(address, AddressTx{Hash: hash, Height: height}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Chain) unindexTransaction(tx *proto.Transaction, hash string) error {
+	addresses, err := c.transactionAddresses(tx)
+	if err != nil {
+		return err
+	}
+	for i, output := range tx.Outputs {
+		if types.IsDataOutput(output) {
+			continue
+		}
+		if err := c.addrIndex.RemoveOutput(output.Address, fmt.Sprintf("%s_%d", hash, i)); err != nil {
+			return err
+		}
+	}
+	for _, address := range addresses {
+		if err := c.addrIndex.RemoveTransaction(address, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transactionAddresses returns the addresses tx spends from and pays to,
+// each once.
+func (c *Chain) transactionAddresses(tx *proto.Transaction) ([][]byte, error) {
+	var (
+		addresses = [][]byte{}
+		seen      = map[string]bool{}
+	)
+	add := func(address []byte) {
+		if !seen[string(address)] {
+			seen[string(address)] = true
+			addresses = append(addresses, address)
+		}
+	}
+	for _, input := range tx.Inputs {
+		key := fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+		utxo, err := c.utxoStore.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		add(utxo.Address)
+	}
+	for _, output := range tx.Outputs {
+		if !types.IsDataOutput(output) {
+			add(output.Address)
+		}
+	}
+	return addresses, nil
+}
+
 func (c *Chain) GetBlockByHash(hash []byte) (*proto.Block, error) {
 	hashHex := hex.EncodeToString(hash)
 	return c.blockStore.Get(hashHex)
 }
 
+// HasBlock reports whether the block with hash is part of the chain
+func (c *Chain) HasBlock(hash []byte) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.hasBlock(hash)
+}
+
+func (c *Chain) hasBlock(hash []byte) bool {
+	b, err := c.blockStore.Get(hex.EncodeToString(hash))
+	if err != nil {
+		return false
+	}
+	height := int(b.Header.Height)
+	if height < 0 || height > c.headers.Height() {
+		return false
+	}
+	return bytes.Equal(types.HashHeader(c.headers.Get(height)), hash)
+}
+
 func (c *Chain) GetBlockByHeight(height int) (*proto.Block, error) {
-	if c.Height() < height {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.getBlockByHeight(height)
+}
+
+func (c *Chain) getBlockByHeight(height int) (*proto.Block, error) {
+	if c.headers.Height() < height {
 		return nil, fmt.Errorf("block with height [%d] does not exist", height)
 	}
 	header := c.headers.Get(height)
@@ -131,24 +387,236 @@ func (c *Chain) GetBlockByHeight(height int) (*proto.Block, error) {
 	return c.GetBlockByHash(hash)
 }
 
+// Tip returns the height and the header of the last block
+func (c *Chain) Tip() (int, *proto.Header) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	height := c.headers.Height()
+	return height, c.headers.Get(height)
+}
+
+func (c *Chain) GetTransaction(hash []byte) (*proto.Transaction, error) {
+	return c.txStore.Get(hex.EncodeToString(hash))
+}
+
+// GetUTXOsByAddress returns the unspent outputs paying to address, ordered
+// by transaction hash and output index.
+func (c *Chain) GetUTXOsByAddress(address []byte) ([]*UTXO, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	all, err := c.addressOutputs(address)
+	if err != nil {
+		return nil, err
+	}
+	utxos := []*UTXO{}
+	for _, utxo := range all {
+		if !utxo.Spent {
+			// copied, as spending updates the stored utxo
+			u := *utxo
+			utxos = append(utxos, &u)
+		}
+	}
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].Hash != utxos[j].Hash {
+			return utxos[i].Hash < utxos[j].Hash
+		}
+		return utxos[i].OutIndex < utxos[j].OutIndex
+	})
+	return utxos, nil
+}
+
+// addressOutputs returns the outputs paying to address, from the address
+// index if there is one.
+func (c *Chain) addressOutputs(address []byte) ([]*UTXO, error) {
+	if c.addrIndex == nil {
+		return c.utxoStore.FindByAddress(address)
+	}
+	outpoints, err := c.addrIndex.Outputs(address)
+	if err != nil {
+		return nil, err
+	}
+	utxos := make([]*UTXO, len(outpoints))
+	for i, outpoint := range outpoints {
+		if utxos[i], err = c.utxoStore.Get(outpoint); err != nil {
+			return nil, err
+		}
+	}
+	return utxos, nil
+}
+
+// AddressHistory returns a page of the transactions touching address, newest
+// first, and the number of transactions. It needs an address index.
+func (c *Chain) AddressHistory(address []byte, offset, limit int) ([]AddressTx, int, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.addrIndex == nil {
+		return nil, 0, ErrNoAddressIndex
+	}
+	if offset < 0 || limit < 0 {
+		return nil, 0, fmt.Errorf("invalid page offset %d limit %d", offset, limit)
+	}
+	return c.addrIndex.History(address, offset, limit)
+}
+
+// FindTransactionsByDataPrefix returns a page of the transactions with a
+// data output whose payload starts with prefix, ordered by payload, and the
+// number of such transactions.
+func (c *Chain) FindTransactionsByDataPrefix(prefix []byte, offset, limit int) ([]*proto.Transaction, int, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if len(prefix) == 0 {
+		return nil, 0, ErrEmptyDataPrefix
+	}
+	if offset < 0 || limit < 0 {
+		return nil, 0, fmt.Errorf("invalid page offset %d limit %d", offset, limit)
+	}
+	hashes, err := c.dataIndex.FindByPrefix(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(hashes)
+	if offset > total {
+		offset = total
+	}
+	if limit > total-offset {
+		limit = total - offset
+	}
+	txx := make([]*proto.Transaction, limit)
+	for i, hash := range hashes[offset : offset+limit] {
+		if txx[i], err = c.txStore.Get(hash); err != nil {
+			return nil, 0, err
+		}
+	}
+	return txx, total, nil
+}
+
+// NewBlock assembles an unsigned block extending the tip from the
+// transactions of pool that are valid at its height and timestamp, which is
+// now unless now is not after the median timestamp. Transactions whose
+// timelocks are not satisfied yet are left out, those that can never be
+// included are returned as invalid. The block reward is paid to
+// rewardAddress, unless it is nil.
+func (c *Chain) NewBlock(pool []*proto.Transaction, now time.Time, rewardAddress []byte) (*proto.Block, []*proto.Transaction) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var (
+		height    = c.headers.Height() + 1
+		timestamp = now.UnixNano()
+	)
+	if median := c.medianTimestamp(); timestamp <= median {
+		timestamp = median + 1
+	}
+	b := &proto.Block{
+		Header: &proto.Header{
+			Version:   blockVersion,
+			Height:    int32(height),
+			PrevHash:  types.HashHeader(c.headers.Get(height - 1)),
+			Timestamp: timestamp,
+		},
+	}
+
+	// the size of the block once its root hash and signature are set
+	size := pb.Size(&proto.Block{
+		Header: &proto.Header{
+			Version:   b.Header.Version,
+			Height:    b.Header.Height,
+			PrevHash:  b.Header.PrevHash,
+			RootHash:  make([]byte, sha256.Size),
+			Timestamp: b.Header.Timestamp,
+		},
+		PublicKey: make([]byte, crypto.PubKeyLen),
+		Signature: make([]byte, crypto.SignatureLen),
+	})
+	if reward := c.params.Reward(int64(height)); rewardAddress != nil && reward > 0 {
+		coinbase := types.NewCoinbase(int32(height), rewardAddress, reward)
+		size += blockTxSize(coinbase)
+		b.Transactions = append(b.Transactions, coinbase)
+	}
+	var (
+		invalid = []*proto.Transaction{}
+		spent   = map[string]bool{}
+		issued  = map[string]bool{}
+	)
+	for _, tx := range pool {
+		if len(b.Transactions) == c.params.MaxBlockTxs {
+			break
+		}
+		if err := c.validateTransaction(tx, int64(height), timestamp); err != nil {
+			if RejectCodeOf(err) != RejectNonFinal {
+				invalid = append(invalid, tx)
+			}
+			continue
+		}
+		// of two transactions spending the same output or issuing the same
+		// asset only the first is included
+		conflict := false
+		for _, input := range tx.Inputs {
+			if spent[fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)] {
+				conflict = true
+			}
+		}
+		var assetID string
+		if issuance := tx.Issuance; issuance != nil {
+			assetID = hex.EncodeToString(types.AssetID(issuance.PublicKey, issuance.Name))
+			conflict = conflict || issued[assetID]
+		}
+		txSize := blockTxSize(tx)
+		if conflict || size+txSize > c.params.MaxBlockSize {
+			continue
+		}
+		for _, input := range tx.Inputs {
+			spent[fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)] = true
+		}
+		if tx.Issuance != nil {
+			issued[assetID] = true
+		}
+		size += txSize
+		b.Transactions = append(b.Transactions, tx)
+	}
+	return b, invalid
+}
+
+// blockTxSize returns how much tx adds to the encoded size of a block
+func blockTxSize(tx *proto.Transaction) int {
+	size := pb.Size(tx)
+	return protowire.SizeTag(2) + protowire.SizeBytes(size)
+}
+
 func (c *Chain) ValidateBlock(b *proto.Block) error {
-	// validate the signature
-	if !types.VerifyBlock(b) {
-		return fmt.Errorf("invalid block signature")
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.validateBlock(b)
+}
+
+func (c *Chain) validateBlock(b *proto.Block) error {
+	if err := CheckBlock(c.params, b); err != nil {
+		return err
 	}
 
 	// validate prev hash
-	currentBlock, err := c.GetBlockByHeight(c.Height())
+	currentBlock, err := c.getBlockByHeight(c.headers.Height())
 	if err != nil {
-		return err
+		return &RejectError{Code: RejectInternal, Err: err}
 	}
 	hash := types.HashBlock(currentBlock)
 	if !bytes.Equal(hash, b.Header.PrevHash) {
-		return fmt.Errorf("invalid previous block hash")
+		return reject(RejectUnknownParent, "invalid previous block hash")
+	}
+	if err := c.validateHeader(b.Header, time.Now()); err != nil {
+		return err
 	}
-	// TODO
 	for _, tx := range b.Transactions {
-		if err := c.ValidateTransaction(tx); err != nil {
+		// the coinbase spends nothing, CheckBlock validated it
+		if types.IsCoinbase(tx) {
+			continue
+		}
+		if err := c.validateTransaction(tx, int64(b.Header.Height), b.Header.Timestamp); err != nil {
 			return err
 		}
 	}
@@ -156,65 +624,327 @@ func (c *Chain) ValidateBlock(b *proto.Block) error {
 	return nil
 }
 
+// CheckBlock runs all validations of b that do not depend on the state of
+// the chain, so it can be used before the block is relayed.
+func CheckBlock(params *ChainParams, b *proto.Block) error {
+	if b.Header == nil {
+		return reject(RejectMalformed, "block without header")
+	}
+	// validate the signature
+	if !types.VerifyBlockSignature(b) {
+		return reject(RejectInvalidSignature, "invalid block signature")
+	}
+	// validate the transactions belong to the signed header, a block
+	// without transactions must not have a root hash
+	if !types.VerifyRootHash(b) {
+		return reject(RejectMalformed, "transactions do not match the root hash")
+	}
+	// validate the block limits
+	if size := pb.Size(b); size > params.MaxBlockSize {
+		return reject(RejectMalformed, "%w: size (%d) max (%d)", ErrBlockTooLarge, size, params.MaxBlockSize)
+	}
+	if n := len(b.Transactions); n > params.MaxBlockTxs {
+		return reject(RejectMalformed, "%w: transactions (%d) max (%d)", ErrTooManyTransactions, n, params.MaxBlockTxs)
+	}
+	// validate the total value created by the block
+	if err := verifyBlockAmounts(b); err != nil {
+		return err
+	}
+	// validate no transaction or output is used twice within the block,
+	// transactions are only checked against the committed utxo set
+	if err := verifyBlockSpends(b); err != nil {
+		return err
+	}
+	if err := verifyCoinbase(params, b); err != nil {
+		return err
+	}
+	for _, tx := range b.Transactions {
+		if err := CheckTransaction(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyCoinbase checks that only the first transaction of b is a coinbase
+// and that it pays no more than the reward of the block to plain outputs.
+func verifyCoinbase(params *ChainParams, b *proto.Block) error {
+	for i, tx := range b.Transactions {
+		if !types.IsCoinbase(tx) {
+			continue
+		}
+		if i != 0 {
+			return reject(RejectMalformed, "coinbase transaction at index (%d)", i)
+		}
+		if tx.CoinbaseHeight != b.Header.Height {
+			return reject(RejectMalformed, "coinbase of height (%d) in block of height (%d)", tx.CoinbaseHeight, b.Header.Height)
+		}
+		if len(tx.Inputs) > 0 || tx.Issuance != nil || tx.LockTime != 0 {
+			return reject(RejectMalformed, "coinbase transaction with inputs, issuance or timelock")
+		}
+		var sum int64
+		for _, output := range tx.Outputs {
+			if len(output.AssetId) > 0 || output.Htlc != nil || types.IsDataOutput(output) {
+				return reject(RejectMalformed, "coinbase may only pay plain outputs of the native coin")
+			}
+			var err error
+			if sum, err = types.AddAmounts(sum, output.Amount); err != nil {
+				return reject(RejectMalformed, "coinbase outputs: %w", err)
+			}
+		}
+		if reward := params.Reward(int64(b.Header.Height)); sum > reward {
+			return reject(RejectMalformed, "coinbase pays (%d) more than the block reward (%d)", sum, reward)
+		}
+	}
+	return nil
+}
+
+// validateHeader checks that header can extend the current tip of the chain
+// given the current time.
+func (c *Chain) validateHeader(header *proto.Header, now time.Time) error {
+	if header.Version != blockVersion {
+		return reject(RejectInvalidHeader, "%w: (%d)", ErrUnsupportedVersion, header.Version)
+	}
+	if expected := c.headers.Height() + 1; int(header.Height) != expected {
+		return reject(RejectInvalidHeader, "%w: expected (%d) got (%d)", ErrInvalidHeight, expected, header.Height)
+	}
+	if median := c.medianTimestamp(); header.Timestamp <= median {
+		return reject(RejectInvalidHeader, "%w: median (%d) got (%d)", ErrTimestampTooOld, median, header.Timestamp)
+	}
+	if latest := now.Add(time.Duration(c.params.MaxFutureBlockTime)).UnixNano(); header.Timestamp > latest {
+		return reject(RejectFutureBlock, "%w: max (%d) got (%d)", ErrTimestampTooNew, latest, header.Timestamp)
+	}
+	return nil
+}
+
+// medianTimestamp returns the median timestamp of the last MedianTimeBlocks
+// headers of the chain.
+func (c *Chain) medianTimestamp() int64 {
+	timestamps := []int64{}
+	for i := c.headers.Height(); i >= 0 && len(timestamps) < c.params.MedianTimeBlocks; i-- {
+		timestamps = append(timestamps, c.headers.Get(i).Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2]
+}
+
+// verifyBlockAmounts checks that the outputs of all transactions in b, summed
+// per asset, stay within the valid money range.
+func verifyBlockAmounts(b *proto.Block) error {
+	sumOutputs := map[string]int64{}
+	for _, tx := range b.Transactions {
+		for _, output := range tx.Outputs {
+			assetID := hex.EncodeToString(output.AssetId)
+			sum, err := types.AddAmounts(sumOutputs[assetID], output.Amount)
+			if err != nil {
+				return reject(RejectMalformed, "outputs of block: %w", err)
+			}
+			sumOutputs[assetID] = sum
+		}
+	}
+	return nil
+}
+
+// verifyBlockSpends checks that b contains no duplicate transactions, that
+// no outpoint is spent by more than one input of the block and that no asset
+// is issued twice.
+func verifyBlockSpends(b *proto.Block) error {
+	var (
+		txx    = map[string]bool{}
+		spent  = map[string]string{}
+		issued = map[string]string{}
+	)
+	for _, tx := range b.Transactions {
+		hash := hex.EncodeToString(types.HashTransaction(tx))
+		if txx[hash] {
+			return reject(RejectDuplicate, "duplicate transaction [%s] in block", hash)
+		}
+		txx[hash] = true
+
+		for _, input := range tx.Inputs {
+			key := fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+			if spender, ok := spent[key]; ok {
+				return reject(RejectMalformed, "output [%s] spent by both transaction [%s] and [%s] in block", key, spender, hash)
+			}
+			spent[key] = hash
+		}
+
+		if issuance := tx.Issuance; issuance != nil {
+			assetID := hex.EncodeToString(types.AssetID(issuance.PublicKey, issuance.Name))
+			if issuer, ok := issued[assetID]; ok {
+				return reject(RejectDuplicate, "asset [%s] issued by both transaction [%s] and [%s] in block", assetID, issuer, hash)
+			}
+			issued[assetID] = hash
+		}
+	}
+	return nil
+}
+
+// ValidateTransaction validates tx against the current UTXO set as if it
+// was going to be included in the next block.
 func (c *Chain) ValidateTransaction(tx *proto.Transaction) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.validateTransaction(tx, int64(c.headers.Height()+1), time.Now().UnixNano())
+}
+
+// CheckTransaction runs all validations of tx that do not depend on the
+// state of the chain, so it can be used before the transaction is relayed.
+func CheckTransaction(tx *proto.Transaction) error {
 	// verify signature
 	if !types.VerifyTransaction(tx) {
-		return fmt.Errorf("invalid transaction signature")
+		return reject(RejectInvalidSignature, "invalid transaction signature")
+	}
+	if issuance := tx.Issuance; issuance != nil {
+		if len(issuance.Name) == 0 {
+			return reject(RejectMalformed, "asset issuance without name")
+		}
+		if issuance.Amount <= 0 {
+			return reject(RejectMalformed, "invalid asset issuance amount (%d)", issuance.Amount)
+		}
+		if err := types.VerifyAmount(issuance.Amount); err != nil {
+			return reject(RejectMalformed, "asset issuance: %w", err)
+		}
+	}
+	for i, output := range tx.Outputs {
+		if types.IsDataOutput(output) {
+			if err := types.VerifyDataOutput(output); err != nil {
+				return reject(RejectMalformed, "output [%d]: %w", i, err)
+			}
+			continue
+		}
+		if err := types.VerifyAmount(output.Amount); err != nil {
+			return reject(RejectMalformed, "output [%d]: %w", i, err)
+		}
+		if htlc := output.Htlc; htlc != nil {
+			if len(htlc.HashLock) != sha256.Size {
+				return reject(RejectMalformed, "output [%d]: invalid htlc hash lock length (%d)", i, len(htlc.HashLock))
+			}
+			if htlc.TimeoutHeight <= 0 || htlc.TimeoutHeight >= types.LockTimeThreshold {
+				return reject(RejectMalformed, "output [%d]: invalid htlc timeout height (%d)", i, htlc.TimeoutHeight)
+			}
+		}
+	}
+	return nil
+}
+
+// validateTransaction validates tx for inclusion in a block with the given
+// height and timestamp, which are used to enforce its timelocks.
+func (c *Chain) validateTransaction(tx *proto.Transaction, height int64, timestamp int64) error {
+	if err := CheckTransaction(tx); err != nil {
+		return err
+	}
+	if types.IsCoinbase(tx) {
+		return reject(RejectMalformed, "coinbase transaction outside of its block")
+	}
+	// verify absolute timelock
+	if !types.IsFinalTransaction(tx, height, timestamp) {
+		return reject(RejectNonFinal, "transaction is locked until [%d]", tx.LockTime)
 	}
 	// validate all inputs unspent
 	var (
 		nInputs = len(tx.Inputs)
 		hash    = hex.EncodeToString(types.HashTransaction(tx))
 	)
+	if _, err := c.txStore.Get(hash); err == nil {
+		return reject(RejectDuplicate, "transaction [%s] is already in the chain", hash)
+	}
 
-	sumInputs := int64(0)
+	// amounts are summed per asset, the native coin uses the empty asset id
+	sumInputs := map[string]int64{}
 	for i := 0; i < nInputs; i++ {
-		prevHash := hex.EncodeToString(tx.Inputs[i].PrevTxHash)
-		key := fmt.Sprintf("%s_%d", prevHash, i)
+		input := tx.Inputs[i]
+		prevHash := hex.EncodeToString(input.PrevTxHash)
+		key := fmt.Sprintf("%s_%d", prevHash, input.PrevOutIndex)
 		utxo, err := c.utxoStore.Get(key)
-		sumInputs += utxo.Amount
 		if err != nil {
-			return err
+			return &RejectError{Code: RejectMissingInput, Err: err}
 		}
 		if utxo.Spent {
-			return fmt.Errorf("output [%d] of transaction [%s] is already spent", i, hash)
+			return reject(RejectDoubleSpend, "output [%d] of transaction [%s] is already spent", i, hash)
+		}
+		if err := verifyInputOwner(input, utxo, height); err != nil {
+			return fmt.Errorf("input [%d] of transaction [%s]: %w", i, hash, err)
+		}
+		// verify relative timelock
+		if input.Sequence > 0 && height < int64(utxo.Height)+int64(input.Sequence) {
+			return reject(RejectNonFinal, "input [%d] of transaction [%s] is locked until height [%d]", i, hash, utxo.Height+int(input.Sequence))
+		}
+		assetID := hex.EncodeToString(utxo.AssetID)
+		if sumInputs[assetID], err = types.AddAmounts(sumInputs[assetID], utxo.Amount); err != nil {
+			return reject(RejectMalformed, "inputs of transaction [%s]: %w", hash, err)
 		}
 	}
 
-	sumOutputs := int64(0)
+	// newly issued units count as inputs of the issued asset
+	if issuance := tx.Issuance; issuance != nil {
+		assetID := hex.EncodeToString(types.AssetID(issuance.PublicKey, issuance.Name))
+		if issuer, ok := c.assets[assetID]; ok {
+			return reject(RejectDuplicate, "asset [%s] was already issued by transaction [%s]", assetID, issuer)
+		}
+		sum, err := types.AddAmounts(sumInputs[assetID], issuance.Amount)
+		if err != nil {
+			return reject(RejectMalformed, "issuance of transaction [%s]: %w", hash, err)
+		}
+		sumInputs[assetID] = sum
+	}
+
+	sumOutputs := map[string]int64{}
 	for _, output := range tx.Outputs {
-		sumOutputs += output.Amount
+		if types.IsDataOutput(output) {
+			continue
+		}
+		assetID := hex.EncodeToString(output.AssetId)
+		sum, err := types.AddAmounts(sumOutputs[assetID], output.Amount)
+		if err != nil {
+			return reject(RejectMalformed, "outputs of transaction [%s]: %w", hash, err)
+		}
+		sumOutputs[assetID] = sum
 	}
 
-	if sumInputs < sumOutputs {
-		return fmt.Errorf("insufficient funds unspent (%d) spent (%d)", sumInputs, sumOutputs)
+	for assetID, spent := range sumOutputs {
+		if unspent := sumInputs[assetID]; unspent < spent {
+			if assetID == "" {
+				return reject(RejectInsufficientFunds, "insufficient funds unspent (%d) spent (%d)", unspent, spent)
+			}
+			return reject(RejectInsufficientFunds, "insufficient funds of asset [%s] unspent (%d) spent (%d)", assetID, unspent, spent)
+		}
 	}
 	return nil
 }
 
-func (c *Chain) createGenesisBlock() *proto.Block {
-	privKey := crypto.NewPrivateKeyFromStringSeed(initSeed)
-
-	block := &proto.Block{
-		Header: &proto.Header{
-			Version: 1,
-		},
+// verifyInputOwner checks that input is allowed to spend utxo in a block
+// at the given height. Regular outputs can only be spent by the owner of the
+// output address, hash time-locked outputs either by the output address
+// revealing the preimage or by the refund address after the timeout.
+func verifyInputOwner(input *proto.TxInput, utxo *UTXO, height int64) error {
+	address := crypto.PublicKeyFromBytes(input.PublicKey).Address().Bytes()
+	if utxo.HTLC == nil {
+		if !bytes.Equal(address, utxo.Address) {
+			return reject(RejectUnauthorized, "public key does not own output address")
+		}
+		return nil
 	}
 
-	tx := &proto.Transaction{
-		Version: 1,
-		Inputs:  []*proto.TxInput{},
-		Outputs: []*proto.TxOutput{
-			{
-				Amount:  1000,
-				Address: privKey.Public().Address().Bytes(),
-			},
-		},
+	if len(input.Preimage) > 0 {
+		hashLock := sha256.Sum256(input.Preimage)
+		if !bytes.Equal(hashLock[:], utxo.HTLC.HashLock) {
+			return reject(RejectUnauthorized, "invalid htlc preimage")
+		}
+		if !bytes.Equal(address, utxo.Address) {
+			return reject(RejectUnauthorized, "public key does not own htlc claim address")
+		}
+		return nil
 	}
 
-	block.Transactions = append(block.Transactions, tx)
-
-	types.SignBlock(privKey, block)
-
-	return block
+	if height < utxo.HTLC.TimeoutHeight {
+		return reject(RejectNonFinal, "htlc can not be refunded before height [%d]", utxo.HTLC.TimeoutHeight)
+	}
+	if !bytes.Equal(address, utxo.HTLC.RefundAddress) {
+		return reject(RejectUnauthorized, "public key does not own htlc refund address")
+	}
+	return nil
 }
@@ -1,12 +1,17 @@
 package node
 
 import (
+	"encoding/hex"
+	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/dbkbali/blocker/crypto"
 	"github.com/dbkbali/blocker/proto"
 	"github.com/dbkbali/blocker/types"
 	"github.com/dbkbali/blocker/util"
+	"github.com/dbkbali/blocker/wallet"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -17,19 +22,20 @@ func randomBlock(t *testing.T, chain *Chain) *proto.Block {
 	prevBlock, err := chain.GetBlockByHeight(chain.Height())
 	require.Nil(t, err)
 	block.Header.PrevHash = types.HashBlock(prevBlock)
+	block.Header.Height = int32(chain.Height() + 1)
 	types.SignBlock(privKey, block)
 	return block
 }
 
 func TestNewChain(t *testing.T) {
-	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	chain := NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
 	assert.Equal(t, 0, chain.Height())
 	_, err := chain.GetBlockByHeight(0)
 	assert.Nil(t, err)
 }
 
 func TestChainHeight(t *testing.T) {
-	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	chain := NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
 	for i := 0; i < 10; i++ {
 		block := randomBlock(t, chain)
 
@@ -39,7 +45,7 @@ func TestChainHeight(t *testing.T) {
 }
 
 func TestAddBlock(t *testing.T) {
-	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	chain := NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
 
 	for i := 0; i < 100; i++ {
 		block := randomBlock(t, chain)
@@ -60,7 +66,7 @@ func TestAddBlock(t *testing.T) {
 
 func TestAddBlockWithTxInsufficientFunds(t *testing.T) {
 	var (
-		chain     = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		chain     = NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
 		block     = randomBlock(t, chain)
 		privKey   = crypto.NewPrivateKeyFromStringSeed(initSeed)
 		recipient = crypto.GeneratePrivateKey().Public().Address().Bytes()
@@ -91,12 +97,15 @@ func TestAddBlockWithTxInsufficientFunds(t *testing.T) {
 	sig := types.SignTransaction(privKey, tx)
 	tx.Inputs[0].Signature = sig.Bytes()
 	block.Transactions = append(block.Transactions, tx)
-	require.NotNil(t, chain.AddBlock(block))
+	types.SignBlock(privKey, block)
+	err = chain.AddBlock(block)
+	require.NotNil(t, err)
+	assert.Equal(t, RejectInsufficientFunds, RejectCodeOf(err))
 
 }
 func TestAddBlockWithTxs(t *testing.T) {
 	var (
-		chain     = NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+		chain     = NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
 		block     = randomBlock(t, chain)
 		privKey   = crypto.NewPrivateKeyFromStringSeed(initSeed)
 		recipient = crypto.GeneratePrivateKey().Public().Address().Bytes()
@@ -134,3 +143,616 @@ func TestAddBlockWithTxs(t *testing.T) {
 	types.SignBlock(privKey, block)
 	require.Nil(t, chain.AddBlock(block))
 }
+
+func TestValidateTimelockedTx(t *testing.T) {
+	var (
+		params = fundedParams(1)
+		chain  = NewChain(params, NewMemoryBlockStore(), NewMemoryTXStore())
+	)
+	// transactions outside of a block are validated for the next block,
+	// see TestAddBlockWithTimelockedTx for the timelock rules
+	lock := func(lockTime int64) *proto.Transaction {
+		tx := genesisSpend(params, 0)
+		tx.LockTime = lockTime
+		tx.Inputs[0].Signature = types.SignTransaction(GenesisKey(), tx).Bytes()
+		return tx
+	}
+	assert.Nil(t, chain.ValidateTransaction(lock(1)))
+	assert.Equal(t, RejectNonFinal, RejectCodeOf(chain.ValidateTransaction(lock(2))))
+}
+
+func TestAddBlockWithTimelockedTx(t *testing.T) {
+	var (
+		privKey   = crypto.NewPrivateKeyFromStringSeed(initSeed)
+		recipient = crypto.GeneratePrivateKey().Public().Address().Bytes()
+		now       = time.Now()
+	)
+
+	// timelocks are checked against the height and timestamp of the block
+	tests := []struct {
+		name     string
+		lockTime int64
+		sequence uint32
+		height   int
+		// ahead is how far the block timestamp is ahead of our clock
+		ahead time.Duration
+		valid bool
+	}{
+		{"absolute height not reached", 5, 0, 4, 0, false},
+		{"absolute height reached", 5, 0, 5, 0, true},
+		{"absolute time not reached", now.Add(time.Hour).Unix(), 0, 1, 0, false},
+		{"absolute time reached", now.Add(time.Minute).Unix(), 0, 1, 2 * time.Minute, true},
+		{"relative height not reached", 0, 3, 2, 0, false},
+		{"relative height reached", 0, 3, 3, 0, true},
+	}
+	for _, tc := range tests {
+		chain := NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
+		for chain.Height() < tc.height-1 {
+			require.Nil(t, chain.AddBlock(randomBlock(t, chain)), tc.name)
+		}
+		prevTx, err := chain.txStore.Get("7c66fa0ecedf3f4748bba3694df77f8b86a197559d9810dde357b78a8badcc8a")
+		require.Nil(t, err)
+
+		tx := &proto.Transaction{
+			Version: 1,
+			Inputs: []*proto.TxInput{
+				{
+					PrevTxHash:   types.HashTransaction(prevTx),
+					PrevOutIndex: 0,
+					PublicKey:    privKey.Public().Bytes(),
+					Sequence:     tc.sequence,
+				},
+			},
+			Outputs: []*proto.TxOutput{
+				{
+					Amount:  1000,
+					Address: recipient,
+				},
+			},
+			LockTime: tc.lockTime,
+		}
+		tx.Inputs[0].Signature = types.SignTransaction(privKey, tx).Bytes()
+
+		block := randomBlock(t, chain)
+		block.Header.Timestamp = time.Now().Add(tc.ahead).UnixNano()
+		block.Transactions = append(block.Transactions, tx)
+		types.SignBlock(privKey, block)
+
+		err = chain.ValidateBlock(block)
+		if tc.valid {
+			assert.Nil(t, err, tc.name)
+		} else {
+			assert.Equal(t, RejectNonFinal, RejectCodeOf(err), tc.name)
+		}
+	}
+}
+
+func TestAddBlockWithHTLC(t *testing.T) {
+	var (
+		chain       = NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey     = crypto.NewPrivateKeyFromStringSeed(initSeed)
+		recipient   = crypto.GeneratePrivateKey()
+		preimage, h = wallet.NewSwapSecret()
+	)
+
+	prevTx, err := chain.txStore.Get("7c66fa0ecedf3f4748bba3694df77f8b86a197559d9810dde357b78a8badcc8a")
+	require.Nil(t, err)
+
+	coins := []wallet.Coin{{TxHash: types.HashTransaction(prevTx), OutIndex: 0, Amount: 1000}}
+	swapTx, err := wallet.CreateSwap(privKey, coins, recipient.Public().Address(), 500, h, 5)
+	require.Nil(t, err)
+
+	addBlock := func(txx ...*proto.Transaction) error {
+		block := randomBlock(t, chain)
+		block.Transactions = txx
+		types.SignBlock(privKey, block)
+		return chain.AddBlock(block)
+	}
+	require.Nil(t, addBlock(swapTx))
+
+	// the refund is not possible before the timeout
+	refundTx, err := wallet.RefundSwap(privKey, swapTx, 0)
+	require.Nil(t, err)
+	assert.NotNil(t, addBlock(refundTx))
+
+	// only the recipient can claim
+	stolenTx, err := wallet.ClaimSwap(privKey, swapTx, 0, preimage)
+	require.Nil(t, err)
+	assert.NotNil(t, addBlock(stolenTx))
+
+	claimTx, err := wallet.ClaimSwap(recipient, swapTx, 0, preimage)
+	require.Nil(t, err)
+	require.Nil(t, addBlock(claimTx))
+}
+
+func TestCheckTransactionHTLC(t *testing.T) {
+	var (
+		privKey   = crypto.GeneratePrivateKey()
+		recipient = crypto.GeneratePrivateKey()
+		coins     = []wallet.Coin{{TxHash: util.RandomHash(), OutIndex: 0, Amount: 100}}
+		_, h      = wallet.NewSwapSecret()
+	)
+
+	testCases := []struct {
+		name   string
+		modify func(htlc *proto.HTLC)
+		valid  bool
+	}{
+		{"valid", func(htlc *proto.HTLC) {}, true},
+		{"short hash lock", func(htlc *proto.HTLC) { htlc.HashLock = htlc.HashLock[:16] }, false},
+		{"zero timeout height", func(htlc *proto.HTLC) { htlc.TimeoutHeight = 0 }, false},
+		{"timeout timestamp", func(htlc *proto.HTLC) { htlc.TimeoutHeight = types.LockTimeThreshold }, false},
+	}
+	for _, tc := range testCases {
+		tx, err := wallet.CreateSwap(privKey, coins, recipient.Public().Address(), 50, h, 5)
+		require.Nil(t, err)
+		tc.modify(tx.Outputs[0].Htlc)
+		sig := types.SignTransaction(privKey, tx)
+		for _, input := range tx.Inputs {
+			input.Signature = sig.Bytes()
+		}
+
+		err = CheckTransaction(tx)
+		if tc.valid {
+			assert.Nil(t, err, tc.name)
+		} else {
+			assert.Equal(t, RejectMalformed, RejectCodeOf(err), tc.name)
+		}
+	}
+}
+
+func TestAddBlockWithAssetIssuance(t *testing.T) {
+	var (
+		chain     = NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey   = crypto.NewPrivateKeyFromStringSeed(initSeed)
+		recipient = crypto.GeneratePrivateKey()
+		assetID   = types.AssetID(privKey.Public().Bytes(), "GOLD")
+	)
+
+	prevTx, err := chain.txStore.Get("7c66fa0ecedf3f4748bba3694df77f8b86a197559d9810dde357b78a8badcc8a")
+	require.Nil(t, err)
+
+	addBlock := func(tx *proto.Transaction) error {
+		block := randomBlock(t, chain)
+		block.Transactions = append(block.Transactions, tx)
+		types.SignBlock(privKey, block)
+		return chain.AddBlock(block)
+	}
+
+	issueTx := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash:   types.HashTransaction(prevTx),
+				PrevOutIndex: 0,
+				PublicKey:    privKey.Public().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  1000,
+				Address: privKey.Public().Address().Bytes(),
+			},
+			{
+				Amount:  500,
+				Address: recipient.Public().Address().Bytes(),
+				AssetId: assetID,
+			},
+		},
+		Issuance: &proto.AssetIssuance{
+			Name:      "GOLD",
+			Amount:    500,
+			PublicKey: privKey.Public().Bytes(),
+		},
+	}
+	sig := types.SignTransaction(privKey, issueTx)
+	issueTx.Inputs[0].Signature = sig.Bytes()
+	issueTx.Issuance.Signature = sig.Bytes()
+	require.Nil(t, addBlock(issueTx))
+
+	spendAsset := func(amount int64) *proto.Transaction {
+		tx := &proto.Transaction{
+			Version: 1,
+			Inputs: []*proto.TxInput{
+				{
+					PrevTxHash:   types.HashTransaction(issueTx),
+					PrevOutIndex: 1,
+					PublicKey:    recipient.Public().Bytes(),
+				},
+			},
+			Outputs: []*proto.TxOutput{
+				{
+					Amount:  amount,
+					Address: privKey.Public().Address().Bytes(),
+					AssetId: assetID,
+				},
+			},
+		}
+		tx.Inputs[0].Signature = types.SignTransaction(recipient, tx).Bytes()
+		return tx
+	}
+
+	// tokens can not be created from nothing
+	assert.NotNil(t, addBlock(spendAsset(501)))
+	require.Nil(t, addBlock(spendAsset(500)))
+
+	// an asset can only be issued once
+	reissue := func(name string) *proto.Transaction {
+		tx := &proto.Transaction{
+			Version: 1,
+			Inputs: []*proto.TxInput{
+				{
+					PrevTxHash:   types.HashTransaction(issueTx),
+					PrevOutIndex: 0,
+					PublicKey:    privKey.Public().Bytes(),
+				},
+			},
+			Outputs: []*proto.TxOutput{
+				{
+					Amount:  1000,
+					Address: privKey.Public().Address().Bytes(),
+				},
+				{
+					Amount:  100,
+					Address: recipient.Public().Address().Bytes(),
+					AssetId: types.AssetID(privKey.Public().Bytes(), name),
+				},
+			},
+			Issuance: &proto.AssetIssuance{
+				Name:      name,
+				Amount:    100,
+				PublicKey: privKey.Public().Bytes(),
+			},
+		}
+		sig := types.SignTransaction(privKey, tx)
+		tx.Inputs[0].Signature = sig.Bytes()
+		tx.Issuance.Signature = sig.Bytes()
+		return tx
+	}
+	assert.Equal(t, RejectDuplicate, RejectCodeOf(chain.ValidateTransaction(reissue("GOLD"))))
+	assert.Equal(t, RejectDuplicate, RejectCodeOf(addBlock(reissue("GOLD"))))
+	require.Nil(t, addBlock(reissue("SILVER")))
+
+	// the asset can be issued again once its issuance is disconnected
+	_, err = chain.DisconnectTip()
+	require.Nil(t, err)
+	assert.Nil(t, chain.ValidateTransaction(reissue("SILVER")))
+}
+
+func TestAddBlockWithDataOutput(t *testing.T) {
+	var (
+		chain   = NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey = crypto.NewPrivateKeyFromStringSeed(initSeed)
+		docHash = append([]byte("DOC:"), util.RandomHash()...)
+	)
+
+	prevTx, err := chain.txStore.Get("7c66fa0ecedf3f4748bba3694df77f8b86a197559d9810dde357b78a8badcc8a")
+	require.Nil(t, err)
+
+	makeTx := func(data *proto.TxOutput) *proto.Transaction {
+		tx := &proto.Transaction{
+			Version: 1,
+			Inputs: []*proto.TxInput{
+				{
+					PrevTxHash:   types.HashTransaction(prevTx),
+					PrevOutIndex: 0,
+					PublicKey:    privKey.Public().Bytes(),
+				},
+			},
+			Outputs: []*proto.TxOutput{
+				{
+					Amount:  1000,
+					Address: privKey.Public().Address().Bytes(),
+				},
+				data,
+			},
+		}
+		tx.Inputs[0].Signature = types.SignTransaction(privKey, tx).Bytes()
+		return tx
+	}
+	addBlock := func(tx *proto.Transaction) error {
+		block := randomBlock(t, chain)
+		block.Transactions = append(block.Transactions, tx)
+		types.SignBlock(privKey, block)
+		return chain.AddBlock(block)
+	}
+
+	assert.NotNil(t, addBlock(makeTx(&proto.TxOutput{Amount: 1, Data: docHash})))
+	assert.NotNil(t, addBlock(makeTx(&proto.TxOutput{Data: make([]byte, types.MaxDataLen+1)})))
+
+	tx := makeTx(&proto.TxOutput{Data: docHash})
+	require.Nil(t, addBlock(tx))
+
+	// the data output never enters the utxo set
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	_, err = chain.utxoStore.Get(fmt.Sprintf("%s_%d", hash, 1))
+	assert.NotNil(t, err)
+
+	txx, total, err := chain.FindTransactionsByDataPrefix([]byte("DOC:"), 0, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 1, total)
+	require.Equal(t, 1, len(txx))
+	assert.Equal(t, tx, txx[0])
+
+	txx, total, err = chain.FindTransactionsByDataPrefix([]byte("DOC:"), 1, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 0, len(txx))
+
+	txx, total, err = chain.FindTransactionsByDataPrefix([]byte("NOPE"), 0, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 0, total)
+	assert.Equal(t, 0, len(txx))
+
+	_, _, err = chain.FindTransactionsByDataPrefix(nil, 0, 10)
+	assert.Equal(t, ErrEmptyDataPrefix, err)
+}
+
+func FuzzValidateTransactionAmounts(f *testing.F) {
+	var (
+		chain   = NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey = crypto.NewPrivateKeyFromStringSeed(initSeed)
+	)
+	prevTx, err := chain.txStore.Get("7c66fa0ecedf3f4748bba3694df77f8b86a197559d9810dde357b78a8badcc8a")
+	require.Nil(f, err)
+
+	f.Add(int64(100), int64(900))
+	f.Add(int64(-1), int64(1001))
+	f.Add(int64(math.MaxInt64), int64(1001))
+	f.Add(int64(math.MaxInt64), int64(math.MaxInt64))
+	f.Add(types.MaxMoney, int64(1))
+
+	f.Fuzz(func(t *testing.T, a, b int64) {
+		tx := &proto.Transaction{
+			Version: 1,
+			Inputs: []*proto.TxInput{
+				{
+					PrevTxHash:   types.HashTransaction(prevTx),
+					PrevOutIndex: 0,
+					PublicKey:    privKey.Public().Bytes(),
+				},
+			},
+			Outputs: []*proto.TxOutput{
+				{Amount: a, Address: privKey.Public().Address().Bytes()},
+				{Amount: b, Address: privKey.Public().Address().Bytes()},
+			},
+		}
+		tx.Inputs[0].Signature = types.SignTransaction(privKey, tx).Bytes()
+
+		if err := chain.ValidateTransaction(tx); err != nil {
+			return
+		}
+		// the genesis output holds 1000 coins, anything more is minted money
+		if a < 0 || b < 0 || a > 1000 || b > 1000 || a+b > 1000 {
+			t.Fatalf("accepted transaction minting money with outputs %d and %d", a, b)
+		}
+	})
+}
+
+func TestAddBlockWithDoubleSpend(t *testing.T) {
+	var (
+		chain   = NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
+		privKey = crypto.NewPrivateKeyFromStringSeed(initSeed)
+	)
+
+	prevTx, err := chain.txStore.Get("7c66fa0ecedf3f4748bba3694df77f8b86a197559d9810dde357b78a8badcc8a")
+	require.Nil(t, err)
+
+	spend := func() *proto.Transaction {
+		tx := &proto.Transaction{
+			Version: 1,
+			Inputs: []*proto.TxInput{
+				{
+					PrevTxHash:   types.HashTransaction(prevTx),
+					PrevOutIndex: 0,
+					PublicKey:    privKey.Public().Bytes(),
+				},
+			},
+			Outputs: []*proto.TxOutput{
+				{
+					Amount:  1000,
+					Address: crypto.GeneratePrivateKey().Public().Address().Bytes(),
+				},
+			},
+		}
+		tx.Inputs[0].Signature = types.SignTransaction(privKey, tx).Bytes()
+		return tx
+	}
+
+	// two different transactions spending the same output
+	block := randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, spend(), spend())
+	types.SignBlock(privKey, block)
+	assert.Equal(t, RejectMalformed, RejectCodeOf(chain.AddBlock(block)))
+
+	// the same transaction twice
+	tx := spend()
+	block = randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, tx, tx)
+	types.SignBlock(privKey, block)
+	assert.NotNil(t, chain.AddBlock(block))
+
+	assert.Equal(t, 0, chain.Height())
+}
+
+func TestAddBlockWithDuplicateTransaction(t *testing.T) {
+	var (
+		params = fundedParams(1)
+		chain  = NewChain(params, NewMemoryBlockStore(), NewMemoryTXStore())
+		tx     = genesisSpend(params, 0)
+	)
+	assert.Equal(t, RejectDuplicate, RejectCodeOf(chain.AddBlock(signedBlock(params, tx, tx))))
+
+	require.Nil(t, chain.AddBlock(signedBlock(params, tx)))
+	assert.Equal(t, RejectDuplicate, RejectCodeOf(chain.ValidateTransaction(tx)))
+}
+
+func TestValidateBlockHeader(t *testing.T) {
+	chain := NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
+	for i := 0; i < 5; i++ {
+		require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*proto.Header)
+		err    error
+	}{
+		{"unsupported version", func(h *proto.Header) { h.Version = 2 }, ErrUnsupportedVersion},
+		{"height too low", func(h *proto.Header) { h.Height = 5 }, ErrInvalidHeight},
+		{"height too high", func(h *proto.Header) { h.Height = 7 }, ErrInvalidHeight},
+		{"timestamp before median", func(h *proto.Header) { h.Timestamp = 1 }, ErrTimestampTooOld},
+		{"timestamp in the future", func(h *proto.Header) {
+			h.Timestamp = time.Now().Add(time.Duration(chain.params.MaxFutureBlockTime) + time.Minute).UnixNano()
+		}, ErrTimestampTooNew},
+	}
+	for _, tc := range tests {
+		block := randomBlock(t, chain)
+		tc.modify(block.Header)
+		types.SignBlock(crypto.GeneratePrivateKey(), block)
+		assert.ErrorIs(t, chain.AddBlock(block), tc.err, tc.name)
+	}
+
+	block := randomBlock(t, chain)
+	for i := 0; i <= chain.params.MaxBlockTxs; i++ {
+		block.Transactions = append(block.Transactions, &proto.Transaction{Version: 1, LockTime: int64(i)})
+	}
+	types.SignBlock(crypto.GeneratePrivateKey(), block)
+	assert.ErrorIs(t, chain.AddBlock(block), ErrTooManyTransactions)
+
+	block = randomBlock(t, chain)
+	block.Transactions = append(block.Transactions, &proto.Transaction{
+		Version: 1,
+		Outputs: []*proto.TxOutput{{Amount: 1, Address: make([]byte, chain.params.MaxBlockSize)}},
+	})
+	types.SignBlock(crypto.GeneratePrivateKey(), block)
+	assert.ErrorIs(t, chain.AddBlock(block), ErrBlockTooLarge)
+
+	// a block ahead of our clock is not misbehaviour and is taken once our
+	// clock caught up
+	block = randomBlock(t, chain)
+	block.Header.Timestamp = time.Now().Add(time.Duration(chain.params.MaxFutureBlockTime) + time.Minute).UnixNano()
+	types.SignBlock(crypto.GeneratePrivateKey(), block)
+	code := RejectCodeOf(chain.AddBlock(block))
+	assert.Equal(t, RejectFutureBlock, code)
+	assert.False(t, code.Misbehaving())
+	assert.True(t, code.Retryable())
+	assert.Nil(t, chain.validateHeader(block.Header, time.Now().Add(2*time.Minute)))
+
+	require.Nil(t, chain.AddBlock(randomBlock(t, chain)))
+}
+
+func TestAddressIndex(t *testing.T) {
+	var (
+		params  = fundedParams(2)
+		chain   = NewChain(params, NewMemoryBlockStore(), NewMemoryTXStore())
+		address = genesisKey.Address().Bytes()
+	)
+	_, _, err := chain.AddressHistory(address, 0, 10)
+	assert.Equal(t, ErrNoAddressIndex, err)
+
+	// the genesis block is indexed when the index is set
+	require.Nil(t, chain.SetAddressIndex(NewMemoryAddressIndex()))
+	genesisTx := hex.EncodeToString(types.HashTransaction(params.Genesis.Block().Transactions[0]))
+	txx, total, err := chain.AddressHistory(address, 0, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, []AddressTx{{Hash: genesisTx, Height: 0}}, txx)
+
+	block := randomBlock(t, chain)
+	block.Transactions = []*proto.Transaction{genesisSpend(params, 0)}
+	types.SignBlock(crypto.GeneratePrivateKey(), block)
+	require.Nil(t, chain.AddBlock(block))
+	var (
+		spendTx   = hex.EncodeToString(types.HashTransaction(block.Transactions[0]))
+		recipient = block.Transactions[0].Outputs[0].Address
+	)
+
+	txx, total, err = chain.AddressHistory(address, 0, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []AddressTx{{Hash: spendTx, Height: 1}, {Hash: genesisTx, Height: 0}}, txx)
+	txx, _, err = chain.AddressHistory(address, 1, 1)
+	require.Nil(t, err)
+	assert.Equal(t, []AddressTx{{Hash: genesisTx, Height: 0}}, txx)
+	txx, _, err = chain.AddressHistory(recipient, 0, 10)
+	require.Nil(t, err)
+	assert.Equal(t, []AddressTx{{Hash: spendTx, Height: 1}}, txx)
+
+	utxos, err := chain.GetUTXOsByAddress(address)
+	require.Nil(t, err)
+	require.Len(t, utxos, 1)
+	assert.Equal(t, 1, utxos[0].OutIndex)
+
+	// disconnecting the block rolls the index and the utxos back
+	disconnected, err := chain.DisconnectTip()
+	require.Nil(t, err)
+	assert.Equal(t, block, disconnected)
+	assert.Equal(t, 0, chain.Height())
+	_, err = chain.GetBlockByHash(types.HashBlock(block))
+	assert.NotNil(t, err)
+	assert.False(t, chain.HasBlock(types.HashBlock(block)))
+	_, err = chain.GetTransaction(types.HashTransaction(block.Transactions[0]))
+	assert.NotNil(t, err)
+	txx, total, err = chain.AddressHistory(address, 0, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, []AddressTx{{Hash: genesisTx, Height: 0}}, txx)
+	_, total, err = chain.AddressHistory(recipient, 0, 10)
+	require.Nil(t, err)
+	assert.Equal(t, 0, total)
+	utxos, err = chain.GetUTXOsByAddress(address)
+	require.Nil(t, err)
+	assert.Len(t, utxos, 2)
+	utxos, err = chain.GetUTXOsByAddress(recipient)
+	require.Nil(t, err)
+	assert.Len(t, utxos, 0)
+
+	// the restored output can be spent again
+	require.Nil(t, chain.AddBlock(block))
+	_, err = chain.DisconnectTip()
+	require.Nil(t, err)
+	_, err = chain.DisconnectTip()
+	assert.NotNil(t, err)
+}
+
+func TestCheckBlockWithoutTransactions(t *testing.T) {
+	var (
+		chain = NewChain(&DevnetParams, NewMemoryBlockStore(), NewMemoryTXStore())
+		block = signedBlock(&DevnetParams, randomTx())
+	)
+	stripped := &proto.Block{Header: block.Header, PublicKey: block.PublicKey, Signature: block.Signature}
+	assert.Equal(t, RejectMalformed, RejectCodeOf(CheckBlock(&DevnetParams, stripped)))
+
+	require.Nil(t, CheckBlock(&DevnetParams, block))
+	require.Nil(t, chain.AddBlock(block))
+}
+
+func TestCheckBlockCoinbase(t *testing.T) {
+	var (
+		params  = fundedParams(1)
+		chain   = NewChain(params, NewMemoryBlockStore(), NewMemoryTXStore())
+		address = crypto.GeneratePrivateKey().Public().Address().Bytes()
+		reward  = params.Reward(1)
+	)
+	tests := []struct {
+		name string
+		txx  []*proto.Transaction
+	}{
+		{"more than the reward", []*proto.Transaction{types.NewCoinbase(1, address, reward+1)}},
+		{"not the first transaction", []*proto.Transaction{genesisSpend(params, 0), types.NewCoinbase(1, address, reward)}},
+		{"other height", []*proto.Transaction{types.NewCoinbase(2, address, reward)}},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, RejectMalformed, RejectCodeOf(CheckBlock(params, signedBlock(params, tc.txx...))), tc.name)
+	}
+
+	// a coinbase is only valid in its own block
+	coinbase := types.NewCoinbase(1, address, reward)
+	assert.Equal(t, RejectMalformed, RejectCodeOf(chain.ValidateTransaction(coinbase)))
+	require.Nil(t, chain.AddBlock(signedBlock(params, coinbase, genesisSpend(params, 0))))
+	utxos, err := chain.GetUTXOsByAddress(address)
+	require.Nil(t, err)
+	require.Len(t, utxos, 1)
+	assert.Equal(t, reward, utxos[0].Amount)
+}
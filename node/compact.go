@@ -0,0 +1,187 @@
+package node
+
+import (
+	"encoding/hex"
+	"math/rand"
+
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// relayBlock sends b as compact block to every peer not known to have it
+func (n *Node) relayBlock(b *proto.Block) {
+	hash := hex.EncodeToString(types.HashBlock(b))
+	for _, p := range n.getPeers() {
+		if p.known.Add(hash) {
+			go n.sendCompactBlock(p, b)
+		}
+	}
+}
+
+// sendCompactBlock sends b to p, prefilling the transactions p is not known
+// to have.
+func (n *Node) sendCompactBlock(p *remotePeer, b *proto.Block) {
+	cb := types.NewCompactBlock(b, rand.Uint64(), func(tx *proto.Transaction) bool {
+		return !p.known.Has(hex.EncodeToString(types.HashTransaction(tx)))
+	})
+	err := p.stream.Send(&proto.Envelope{
+		Payload: &proto.Envelope_CompactBlock{CompactBlock: cb},
+	})
+	if err != nil {
+		n.logger.Debugw("sending compact block failed", "we", n.ListenAddr, "remoteNode", p.handshake.ListenAddr, "err", err)
+	}
+}
+
+// handleCompactBlock checks the header of a compact block relayed by the
+// peer nodeID and starts the reconstruction of the block if it is new.
+func (n *Node) handleCompactBlock(nodeID string, cb *proto.CompactBlock) error {
+	p, err := n.connectedPeer(nodeID)
+	if err != nil {
+		return err
+	}
+	if cb.Header == nil {
+		err := reject(RejectMalformed, "compact block without header")
+		n.rejected(nodeID, err)
+		return err
+	}
+	if types.CompactBlockTxCount(cb) > n.Params.MaxBlockTxs {
+		err := reject(RejectMalformed, "%w", ErrTooManyTransactions)
+		n.rejected(nodeID, err)
+		return err
+	}
+
+	hash := hex.EncodeToString(types.HashHeader(cb.Header))
+	p.known.Add(hash)
+	if n.seen.Has(hash) {
+		return nil
+	}
+	// the signature covers the header only, so it is checked before any
+	// transactions are fetched
+	header := &proto.Block{Header: cb.Header, PublicKey: cb.PublicKey, Signature: cb.Signature}
+	if !types.VerifyBlockSignature(header) {
+		err := reject(RejectInvalidSignature, "invalid compact block signature")
+		n.rejected(nodeID, err)
+		return err
+	}
+	if !n.request(hash) {
+		return nil
+	}
+
+	go n.completeCompactBlock(nodeID, p, cb)
+	return nil
+}
+
+func (n *Node) getBlockTxn(req *proto.GetBlockTxnRequest) (*proto.BlockTxnResponse, error) {
+	b, err := n.chain.GetBlockByHash(req.BlockHash)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "block [%x] not found", req.BlockHash)
+	}
+
+	resp := &proto.BlockTxnResponse{BlockHash: req.BlockHash}
+	for _, index := range req.Indexes {
+		if int(index) >= len(b.Transactions) {
+			return nil, reject(RejectMalformed, "transaction index %d out of range", index)
+		}
+		resp.Transactions = append(resp.Transactions, b.Transactions[index])
+	}
+	return resp, nil
+}
+
+// completeCompactBlock rebuilds the block of cb from our mempool and the
+// transactions we lack, which are requested from p.
+func (n *Node) completeCompactBlock(nodeID string, p *remotePeer, cb *proto.CompactBlock) {
+	blockHash := types.HashHeader(cb.Header)
+	defer n.requestDone(hex.EncodeToString(blockHash))
+
+	txx, missing, err := fillCompactBlock(cb, n.mempool.Transactions())
+	if err != nil {
+		n.rejected(nodeID, err)
+		return
+	}
+	if len(missing) > 0 {
+		reply, err := p.stream.Request(&proto.Envelope{
+			Payload: &proto.Envelope_GetBlockTxn{GetBlockTxn: &proto.GetBlockTxnRequest{BlockHash: blockHash, Indexes: missing}},
+		}, sendTimeout)
+		if err != nil {
+			n.logger.Debugw("getblocktxn failed", "we", n.ListenAddr, "nodeID", nodeID, "err", err)
+			return
+		}
+		resp := reply.GetBlockTxn_()
+		if len(resp.GetTransactions()) != len(missing) {
+			n.rejected(nodeID, reject(RejectMalformed, "expected %d block transactions got %d", len(missing), len(resp.GetTransactions())))
+			return
+		}
+		for i, index := range missing {
+			txx[index] = resp.Transactions[i]
+		}
+	}
+
+	b := &proto.Block{
+		Header:       cb.Header,
+		Transactions: txx,
+		PublicKey:    cb.PublicKey,
+		Signature:    cb.Signature,
+	}
+	err = n.processBlock(b)
+	if err == nil {
+		return
+	}
+	if len(missing) == len(cb.ShortIds) {
+		// all transactions came from the peer
+		n.rejected(nodeID, err)
+		return
+	}
+
+	// a short id of the block matched a different transaction of our
+	// mempool, so we fall back to fetching the full block
+	n.logger.Debugw("compact block reconstruction failed", "we", n.ListenAddr, "hash", hex.EncodeToString(blockHash), "err", err)
+	n.requestDone(hex.EncodeToString(blockHash))
+	if n.request(hex.EncodeToString(blockHash)) {
+		n.fetchData(nodeID, p, []*proto.InvItem{{Type: proto.InvType_INV_BLOCK, Hash: blockHash}})
+	}
+}
+
+// fillCompactBlock places the prefilled transactions of cb and those of pool
+// matching its short ids. It returns the indexes of the transactions that are
+// still missing.
+func fillCompactBlock(cb *proto.CompactBlock, pool []*proto.Transaction) ([]*proto.Transaction, []uint32, error) {
+	txx := make([]*proto.Transaction, types.CompactBlockTxCount(cb))
+	for _, prefilled := range cb.Prefilled {
+		if prefilled.Transaction == nil || int(prefilled.Index) >= len(txx) || txx[prefilled.Index] != nil {
+			return nil, nil, reject(RejectMalformed, "invalid prefilled transaction at index %d", prefilled.Index)
+		}
+		txx[prefilled.Index] = prefilled.Transaction
+	}
+
+	var (
+		byShortID = make(map[uint64]*proto.Transaction, len(pool))
+		collided  = make(map[uint64]bool)
+	)
+	for _, tx := range pool {
+		id := types.ShortTxID(cb.Nonce, types.HashTransaction(tx))
+		if _, ok := byShortID[id]; ok {
+			collided[id] = true
+		}
+		byShortID[id] = tx
+	}
+
+	var (
+		missing = []uint32{}
+		next    = 0
+	)
+	for i := range txx {
+		if txx[i] != nil {
+			continue
+		}
+		id := cb.ShortIds[next]
+		next++
+		if tx, ok := byShortID[id]; ok && !collided[id] {
+			txx[i] = tx
+			continue
+		}
+		missing = append(missing, uint32(i))
+	}
+	return txx, missing, nil
+}
@@ -0,0 +1,83 @@
+package node
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFillCompactBlock(t *testing.T) {
+	var (
+		txx = []*proto.Transaction{randomTx(), randomTx(), randomTx()}
+		b   = signedBlock(&DevnetParams, txx...)
+		cb  = types.NewCompactBlock(b, 7, func(tx *proto.Transaction) bool { return tx == txx[2] })
+	)
+
+	filled, missing, err := fillCompactBlock(cb, []*proto.Transaction{txx[0], randomTx()})
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{1}, missing)
+	assert.Equal(t, txx[0], filled[0])
+	assert.Nil(t, filled[1])
+	assert.Equal(t, txx[2], filled[2])
+
+	cb.Prefilled[0].Index = 5
+	_, _, err = fillCompactBlock(cb, nil)
+	assert.Equal(t, RejectMalformed, RejectCodeOf(err))
+}
+
+func TestCompactBlockRelay(t *testing.T) {
+	var (
+		params = fundedParams(3)
+		a      = makeTestNode(t, params)
+		b      = makeTestNode(t, params)
+	)
+	connectTestNodes(t, a, b)
+
+	// b learns one of the transactions through gossip
+	known := genesisSpend(params, 0)
+	require.Nil(t, a.processTransaction(known))
+	assert.Eventually(t, func() bool { return b.mempool.Has(known) }, 2*time.Second, 10*time.Millisecond)
+
+	block := signedBlock(params, known, genesisSpend(params, 1), genesisSpend(params, 2))
+	require.Nil(t, a.processBlock(block))
+
+	hash := types.HashBlock(block)
+	assert.Eventually(t, func() bool { return b.chain.Height() == 1 }, 2*time.Second, 10*time.Millisecond)
+	relayed, err := b.chain.GetBlockByHash(hash)
+	require.Nil(t, err)
+	assert.Equal(t, len(block.Transactions), len(relayed.Transactions))
+	assert.True(t, b.seen.Has(hex.EncodeToString(hash)))
+	// the confirmed transaction left the mempool
+	assert.False(t, b.mempool.Has(known))
+}
+
+func TestCompactBlockFetchesMissingTransactions(t *testing.T) {
+	var (
+		params = fundedParams(3)
+		a      = makeTestNode(t, params)
+		b      = makeTestNode(t, params)
+	)
+	connectTestNodes(t, a, b)
+
+	known := genesisSpend(params, 1)
+	b.mempool.Add(known)
+	block := signedBlock(params, genesisSpend(params, 0), known, genesisSpend(params, 2))
+	require.Nil(t, a.chain.AddBlock(block))
+
+	// nothing is prefilled, so b has to fetch two transactions from a
+	cb := types.NewCompactBlock(block, 9, func(*proto.Transaction) bool { return false })
+	_, missing, err := fillCompactBlock(cb, b.mempool.Transactions())
+	require.Nil(t, err)
+	assert.Equal(t, []uint32{0, 2}, missing)
+
+	b.completeCompactBlock(a.nodeID, b.getPeers()[a.nodeID], cb)
+	relayed, err := b.chain.GetBlockByHash(types.HashBlock(block))
+	require.Nil(t, err)
+	assert.Equal(t, types.HashTransaction(block.Transactions[0]), types.HashTransaction(relayed.Transactions[0]))
+	assert.True(t, types.VerifyBlock(relayed))
+}
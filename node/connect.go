@@ -0,0 +1,198 @@
+package node
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/dbkbali/blocker/proto"
+)
+
+const (
+	defaultTargetOutbound = 8
+	defaultMaxInbound     = 32
+	// connectInterval is how often the outbound peer count is topped up
+	connectInterval = 5 * time.Second
+	// maxAddrsPerMessage caps the addresses of a single addrs message
+	maxAddrsPerMessage = 1000
+)
+
+// bootstrapNetwork adds the bootstrap nodes to the address book and dials
+// them right away.
+func (n *Node) bootstrapNetwork(bootNodes []string) {
+	for _, addr := range bootNodes {
+		n.addrBook.Add(addr, true)
+	}
+	n.connectPeers()
+}
+
+// connectLoop keeps the number of outbound peers at TargetOutbound by dialing
+// addresses from the address book, and persists the book.
+func (n *Node) connectLoop() {
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.connectPeers()
+		if err := n.addrBook.Save(); err != nil {
+			n.logger.Errorw("saving address book failed", "err", err)
+		}
+	}
+}
+
+// connectPeers dials as many addresses as outbound peers are missing
+func (n *Node) connectPeers() {
+	n.peerLock.Lock()
+	missing := n.TargetOutbound - len(n.dialing)
+	for _, p := range n.peers {
+		if p.outbound {
+			missing--
+		}
+	}
+	n.peerLock.Unlock()
+	if missing <= 0 {
+		return
+	}
+
+	addrs := n.addrBook.DialCandidates(time.Now(), missing, func(addr string) bool {
+		return !n.canConnectWith(addr) || n.isDialing(addr) || n.isConnectedAddr(addr) || n.isBannedAddr(addr)
+	})
+	for _, addr := range addrs {
+		n.peerLock.Lock()
+		n.dialing[addr] = true
+		n.peerLock.Unlock()
+
+		addr := addr
+		n.spawn(func() { n.dialPeer(addr) })
+	}
+}
+
+func (n *Node) dialPeer(addr string) {
+	defer func() {
+		n.peerLock.Lock()
+		delete(n.dialing, addr)
+		n.peerLock.Unlock()
+	}()
+
+	n.logger.Debugw("dialing remote node", "we", n.ListenAddr, "remote", addr)
+	conn, h, err := n.dialRemoteNode(addr)
+	if err != nil {
+		n.addrBook.Failed(addr)
+		known, _ := n.addrBook.Get(addr)
+		n.logger.Debugw("dial failed", "we", n.ListenAddr, "remote", addr, "failures", known.Failures, "err", err)
+		return
+	}
+	n.addrBook.Good(addr, h.NodeId)
+	if n.banList.IsBanned(h.NodeId) {
+		conn.Close()
+		return
+	}
+	if !n.addPeer(newRemotePeer(conn, h)) {
+		conn.Close()
+	}
+}
+
+func (n *Node) isDialing(addr string) bool {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	return n.dialing[addr]
+}
+
+// isConnectedAddr reports whether the node last seen at addr is connected
+func (n *Node) isConnectedAddr(addr string) bool {
+	known, ok := n.addrBook.Get(addr)
+	if !ok || len(known.NodeID) == 0 {
+		return false
+	}
+
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	_, ok = n.peers[known.NodeID]
+	return ok
+}
+
+// countPeers returns the number of outbound or inbound peers
+func (n *Node) countPeers(outbound bool) int {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	count := 0
+	for _, p := range n.peers {
+		if p.outbound == outbound {
+			count++
+		}
+	}
+	return count
+}
+
+// requestAddrs asks p for addresses of other nodes and adds the valid ones to
+// the address book, at most maxAddrsPerSource of them.
+func (n *Node) requestAddrs(nodeID string, p *remotePeer) {
+	reply, err := p.stream.Request(&proto.Envelope{
+		Payload: &proto.Envelope_GetAddrs{GetAddrs: &proto.GetAddrsRequest{}},
+	}, sendTimeout)
+	if err != nil {
+		n.logger.Debugw("getaddrs failed", "we", n.ListenAddr, "nodeID", nodeID, "err", err)
+		return
+	}
+	msg := reply.GetAddrs_()
+	if msg == nil || len(msg.Addrs) > maxAddrsPerMessage {
+		n.rejected(nodeID, reject(RejectMalformed, "invalid addrs reply"))
+		return
+	}
+
+	added := 0
+	for _, addr := range msg.Addrs {
+		if addr == n.ListenAddr || !validAddr(addr) {
+			continue
+		}
+		if n.addrBook.AddFrom(addr, nodeID) {
+			added++
+		}
+	}
+	n.logger.Debugw("received addresses", "we", n.ListenAddr, "nodeID", nodeID, "addrs", len(msg.Addrs), "added", added)
+}
+
+// getAddrs answers a getaddrs request with a random sample of the addresses
+// we know to be reachable.
+func (n *Node) getAddrs() *proto.AddrsMessage {
+	return &proto.AddrsMessage{
+		Addrs: n.addrBook.Sample(maxAddrsPerMessage),
+	}
+}
+
+// validAddr reports whether addr is a host and port that can be dialed
+func validAddr(addr string) bool {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	return err == nil && port > 0 && port <= 65535
+}
+
+// inboundAddr returns the address an inbound peer connected from remoteHost
+// listens on according to its handshake. The peer can only announce its own
+// host, an empty or unspecified host is replaced by remoteHost.
+func inboundAddr(listenAddr string, remoteHost string) (string, bool) {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", false
+	}
+	remoteIP := net.ParseIP(remoteHost)
+	if remoteIP == nil {
+		return "", false
+	}
+	if ip := net.ParseIP(host); len(host) > 0 && !ip.IsUnspecified() && !ip.Equal(remoteIP) {
+		return "", false
+	}
+	addr := net.JoinHostPort(remoteIP.String(), port)
+	return addr, validAddr(addr)
+}
@@ -0,0 +1,236 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned when a block header violates the consensus rules
+var (
+	ErrUnsupportedVersion  = errors.New("unsupported block version")
+	ErrInvalidHeight       = errors.New("invalid block height")
+	ErrTimestampTooOld     = errors.New("block timestamp is not after the median of recent blocks")
+	ErrTimestampTooNew     = errors.New("block timestamp is too far in the future")
+	ErrBlockTooLarge       = errors.New("block exceeds the max block size")
+	ErrTooManyTransactions = errors.New("block exceeds the max transaction count")
+)
+
+// ErrSelfConnection is wrapped by the RejectSelfConnection error returned
+// when a node receives its own handshake
+var ErrSelfConnection = errors.New("can not connect to ourselves")
+
+// ErrNoAddressIndex is returned for address history queries of a chain
+// without address index
+var ErrNoAddressIndex = errors.New("address index is disabled")
+
+// ErrEmptyDataPrefix is returned for data queries without prefix, which would
+// match every data output of the chain
+var ErrEmptyDataPrefix = errors.New("data prefix must not be empty")
+
+// errorDomain is the domain of the ErrorInfo attached to reject statuses
+const errorDomain = "blocker"
+
+// RejectCode classifies why a transaction, block or peer was rejected
+type RejectCode int
+
+const (
+	RejectUnknown RejectCode = iota
+	// RejectMalformed is returned for data that can never be valid
+	RejectMalformed
+	// RejectInvalidSignature is returned when a signature does not verify
+	RejectInvalidSignature
+	// RejectInvalidHeader is returned when a block header breaks the consensus rules
+	RejectInvalidHeader
+	// RejectUnknownParent is returned for blocks not extending our tip
+	RejectUnknownParent
+	// RejectMissingInput is returned when a spent output is not known (yet)
+	RejectMissingInput
+	// RejectDoubleSpend is returned when an output is already spent
+	RejectDoubleSpend
+	// RejectDuplicate is returned for data we have seen before
+	RejectDuplicate
+	// RejectInsufficientFunds is returned when outputs exceed inputs
+	RejectInsufficientFunds
+	// RejectUnauthorized is returned when an input does not own the output it spends
+	RejectUnauthorized
+	// RejectNonFinal is returned for transactions whose timelocks are not satisfied yet
+	RejectNonFinal
+	// RejectInternal is returned when the node failed to process valid data
+	RejectInternal
+	// RejectWrongNetwork is returned to peers on a different chain
+	RejectWrongNetwork
+	// RejectIncompatibleVersion is returned to peers without a common protocol version
+	RejectIncompatibleVersion
+	// RejectTooManyPeers is returned to peers when no more connections are accepted
+	RejectTooManyPeers
+	// RejectBanned is returned to peers banned for misbehaviour
+	RejectBanned
+	// RejectFutureBlock is returned for blocks too far ahead of our clock,
+	// they are valid once our clock caught up
+	RejectFutureBlock
+	// RejectSelfConnection is returned when a node receives its own handshake
+	RejectSelfConnection
+)
+
+var rejectCodeNames = map[RejectCode]string{
+	RejectUnknown:             "UNKNOWN",
+	RejectMalformed:           "MALFORMED",
+	RejectInvalidSignature:    "INVALID_SIGNATURE",
+	RejectInvalidHeader:       "INVALID_HEADER",
+	RejectUnknownParent:       "UNKNOWN_PARENT",
+	RejectMissingInput:        "MISSING_INPUT",
+	RejectDoubleSpend:         "DOUBLE_SPEND",
+	RejectDuplicate:           "DUPLICATE",
+	RejectInsufficientFunds:   "INSUFFICIENT_FUNDS",
+	RejectUnauthorized:        "UNAUTHORIZED",
+	RejectNonFinal:            "NON_FINAL",
+	RejectInternal:            "INTERNAL",
+	RejectWrongNetwork:        "WRONG_NETWORK",
+	RejectIncompatibleVersion: "INCOMPATIBLE_VERSION",
+	RejectTooManyPeers:        "TOO_MANY_PEERS",
+	RejectBanned:              "BANNED",
+	RejectFutureBlock:         "FUTURE_BLOCK",
+	RejectSelfConnection:      "SELF_CONNECTION",
+}
+
+func (c RejectCode) String() string {
+	if name, ok := rejectCodeNames[c]; ok {
+		return name
+	}
+	return rejectCodeNames[RejectUnknown]
+}
+
+// RejectCodeFromString is the inverse of RejectCode.String
+func RejectCodeFromString(s string) RejectCode {
+	for code, name := range rejectCodeNames {
+		if name == s {
+			return code
+		}
+	}
+	return RejectUnknown
+}
+
+// GRPCCode returns the gRPC status code used to report c to a remote caller
+func (c RejectCode) GRPCCode() codes.Code {
+	switch c {
+	case RejectMalformed, RejectInvalidSignature, RejectInvalidHeader,
+		RejectInsufficientFunds, RejectUnauthorized:
+		return codes.InvalidArgument
+	case RejectUnknownParent, RejectMissingInput, RejectNonFinal,
+		RejectWrongNetwork, RejectIncompatibleVersion, RejectFutureBlock:
+		return codes.FailedPrecondition
+	case RejectDoubleSpend:
+		return codes.Aborted
+	case RejectDuplicate:
+		return codes.AlreadyExists
+	case RejectInternal:
+		return codes.Internal
+	case RejectTooManyPeers:
+		return codes.ResourceExhausted
+	case RejectBanned:
+		return codes.PermissionDenied
+	case RejectSelfConnection:
+		return codes.Canceled
+	default:
+		return codes.Unknown
+	}
+}
+
+// Retryable reports whether the rejected data might become valid later, for
+// example once the node learned about a missing parent or a timelock expired.
+func (c RejectCode) Retryable() bool {
+	switch c {
+	case RejectUnknownParent, RejectMissingInput, RejectNonFinal, RejectInternal,
+		RejectTooManyPeers, RejectFutureBlock:
+		return true
+	default:
+		return false
+	}
+}
+
+// Misbehaving reports whether sending data rejected with c is a sign of a
+// broken or malicious peer, since honest peers validate before relaying.
+func (c RejectCode) Misbehaving() bool {
+	switch c {
+	case RejectMalformed, RejectInvalidSignature, RejectInvalidHeader,
+		RejectInsufficientFunds, RejectUnauthorized:
+		return true
+	default:
+		return false
+	}
+}
+
+// RejectError is returned by the validation of transactions and blocks
+type RejectError struct {
+	Code RejectCode
+	Err  error
+}
+
+func (e *RejectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+// GRPCStatus converts e into a gRPC status carrying the reject code as
+// ErrorInfo reason, so it survives the trip to a remote caller.
+func (e *RejectError) GRPCStatus() *status.Status {
+	st := status.New(e.Code.GRPCCode(), e.Error())
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: e.Code.String(),
+		Domain: errorDomain,
+	})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+func reject(code RejectCode, format string, args ...any) error {
+	return &RejectError{
+		Code: code,
+		Err:  fmt.Errorf(format, args...),
+	}
+}
+
+// RejectCodeOf returns the reject code of err, which is either a RejectError
+// or a gRPC status error received from a remote node.
+func RejectCodeOf(err error) RejectCode {
+	if err == nil {
+		return RejectUnknown
+	}
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		return rejectErr.Code
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return RejectUnknown
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == errorDomain {
+			return RejectCodeFromString(info.Reason)
+		}
+	}
+	return RejectUnknown
+}
+
+// IsRetryable reports whether a call that failed with err may succeed when
+// it is retried later.
+func IsRetryable(err error) bool {
+	if code := RejectCodeOf(err); code != RejectUnknown {
+		return code.Retryable()
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
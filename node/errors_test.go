@@ -0,0 +1,40 @@
+package node
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRejectCodeOf(t *testing.T) {
+	err := reject(RejectUnknownParent, "invalid previous block hash")
+	assert.Equal(t, RejectUnknownParent, RejectCodeOf(err))
+	assert.Equal(t, RejectUnknownParent, RejectCodeOf(fmt.Errorf("wrapped: %w", err)))
+	assert.Equal(t, RejectUnknown, RejectCodeOf(fmt.Errorf("plain error")))
+	assert.Equal(t, RejectUnknown, RejectCodeOf(nil))
+}
+
+func TestRejectErrorGRPCStatus(t *testing.T) {
+	for code := range rejectCodeNames {
+		err := reject(code, "some reason")
+
+		// the error as it arrives at the client
+		remoteErr := status.Convert(err).Err()
+		assert.Equal(t, code.GRPCCode(), status.Code(remoteErr))
+		assert.Equal(t, code, RejectCodeOf(remoteErr))
+		assert.Equal(t, code.Retryable(), IsRetryable(remoteErr))
+	}
+
+	assert.True(t, IsRetryable(status.Error(codes.Unavailable, "connection refused")))
+	assert.False(t, IsRetryable(status.Error(codes.InvalidArgument, "bad request")))
+}
+
+func TestRejectWrapsSentinel(t *testing.T) {
+	err := reject(RejectInvalidHeader, "%w: expected (%d) got (%d)", ErrInvalidHeight, 1, 2)
+	assert.ErrorIs(t, err, ErrInvalidHeight)
+	assert.True(t, RejectInvalidHeader.Misbehaving())
+	assert.False(t, RejectInvalidHeader.Retryable())
+}
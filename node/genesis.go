@@ -0,0 +1,151 @@
+package node
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+)
+
+// GenesisAlloc is an amount of coins assigned to an address in the genesis block
+type GenesisAlloc struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+// GenesisValidator is a member of the initial validator set
+type GenesisValidator struct {
+	PublicKey string `json:"publicKey"`
+	Stake     int64  `json:"stake"`
+}
+
+// Genesis describes the first block of a chain. All nodes of a network have
+// to start from the same genesis, which they verify by comparing its Hash.
+type Genesis struct {
+	ChainID string `json:"chainId"`
+	// Timestamp in unix seconds
+	Timestamp  int64              `json:"timestamp"`
+	Alloc      []GenesisAlloc     `json:"alloc"`
+	Validators []GenesisValidator `json:"validators"`
+}
+
+// LoadGenesis reads a genesis file
+func LoadGenesis(path string) (*Genesis, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	genesis := &Genesis{}
+	if err := json.Unmarshal(b, genesis); err != nil {
+		return nil, fmt.Errorf("invalid genesis [%s]: %w", path, err)
+	}
+	if err := genesis.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid genesis [%s]: %w", path, err)
+	}
+	return genesis, nil
+}
+
+// Save writes g to a genesis file
+func (g *Genesis) Save(path string) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// Validate checks that g describes a usable genesis block
+func (g *Genesis) Validate() error {
+	if len(g.ChainID) == 0 {
+		return fmt.Errorf("missing chain id")
+	}
+	if len(g.Alloc) == 0 {
+		return fmt.Errorf("missing genesis allocation")
+	}
+	total := int64(0)
+	for _, alloc := range g.Alloc {
+		b, err := hex.DecodeString(alloc.Address)
+		if err != nil || len(b) != crypto.AddressLen {
+			return fmt.Errorf("invalid genesis address [%s]", alloc.Address)
+		}
+		if total, err = types.AddAmounts(total, alloc.Amount); err != nil {
+			return fmt.Errorf("genesis allocation: %w", err)
+		}
+	}
+	if len(g.Validators) == 0 {
+		return fmt.Errorf("missing genesis validators")
+	}
+	seen := map[string]bool{}
+	for _, validator := range g.Validators {
+		b, err := hex.DecodeString(validator.PublicKey)
+		if err != nil || len(b) != crypto.PubKeyLen {
+			return fmt.Errorf("invalid validator public key [%s]", validator.PublicKey)
+		}
+		if seen[validator.PublicKey] {
+			return fmt.Errorf("duplicate validator [%s]", validator.PublicKey)
+		}
+		seen[validator.PublicKey] = true
+		if validator.Stake <= 0 {
+			return fmt.Errorf("validator [%s] without stake", validator.PublicKey)
+		}
+		if err := types.VerifyAmount(validator.Stake); err != nil {
+			return fmt.Errorf("validator [%s] stake: %w", validator.PublicKey, err)
+		}
+	}
+	return nil
+}
+
+// Block returns the genesis block described by g. The genesis block has no
+// parent, so its PrevHash commits to the whole genesis instead. That way
+// chains with a different chain id or validator set never share a genesis
+// hash, even if their allocations are the same.
+func (g *Genesis) Block() *proto.Block {
+	tx := &proto.Transaction{
+		Version: 1,
+		Inputs:  []*proto.TxInput{},
+		Outputs: []*proto.TxOutput{},
+	}
+	for _, alloc := range g.Alloc {
+		address, err := hex.DecodeString(alloc.Address)
+		if err != nil {
+			panic(err)
+		}
+		tx.Outputs = append(tx.Outputs, &proto.TxOutput{
+			Amount:  alloc.Amount,
+			Address: address,
+		})
+	}
+
+	b, err := json.Marshal(g)
+	if err != nil {
+		panic(err)
+	}
+	configHash := sha256.Sum256(b)
+
+	block := &proto.Block{
+		Header: &proto.Header{
+			Version:   blockVersion,
+			PrevHash:  configHash[:],
+			Timestamp: time.Unix(g.Timestamp, 0).UnixNano(),
+		},
+		Transactions: []*proto.Transaction{tx},
+	}
+	tree, err := types.GetMerkleTree(block)
+	if err != nil {
+		panic(err)
+	}
+	block.Header.RootHash = tree.MerkleRoot()
+
+	return block
+}
+
+// Hash returns the hash of the genesis block
+func (g *Genesis) Hash() []byte {
+	return types.HashBlock(g.Block())
+}
@@ -0,0 +1,82 @@
+package node
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testGenesis() *Genesis {
+	var (
+		holder    = crypto.GeneratePrivateKey().Public()
+		validator = crypto.GeneratePrivateKey().Public()
+	)
+	return &Genesis{
+		ChainID:   "testchain-1",
+		Timestamp: 1704067200,
+		Alloc: []GenesisAlloc{
+			{Address: genesisKey.Address().String(), Amount: 1000},
+			{Address: holder.Address().String(), Amount: 500},
+		},
+		Validators: []GenesisValidator{
+			{PublicKey: hex.EncodeToString(validator.Bytes()), Stake: 100},
+		},
+	}
+}
+
+func TestGenesisSaveLoad(t *testing.T) {
+	var (
+		genesis = testGenesis()
+		path    = filepath.Join(t.TempDir(), "genesis.json")
+	)
+	require.Nil(t, genesis.Validate())
+	require.Nil(t, genesis.Save(path))
+
+	loaded, err := LoadGenesis(path)
+	require.Nil(t, err)
+	assert.Equal(t, genesis, loaded)
+	assert.Equal(t, genesis.Hash(), loaded.Hash())
+}
+
+func TestGenesisBlock(t *testing.T) {
+	genesis := testGenesis()
+	block := genesis.Block()
+
+	assert.Equal(t, 1, len(block.Transactions))
+	assert.Equal(t, 2, len(block.Transactions[0].Outputs))
+	assert.Equal(t, int64(500), block.Transactions[0].Outputs[1].Amount)
+	assert.True(t, types.VerifyRootHash(block))
+	assert.Equal(t, types.HashBlock(block), genesis.Hash())
+
+	// the hash commits to everything in the genesis
+	other := testGenesis()
+	other.Alloc, other.Timestamp = genesis.Alloc, genesis.Timestamp
+	assert.NotEqual(t, genesis.Hash(), other.Hash())
+	other.Validators = genesis.Validators
+	assert.Equal(t, genesis.Hash(), other.Hash())
+	other.ChainID = "testchain-2"
+	assert.NotEqual(t, genesis.Hash(), other.Hash())
+}
+
+func TestGenesisValidate(t *testing.T) {
+	genesis := testGenesis()
+	genesis.ChainID = ""
+	assert.NotNil(t, genesis.Validate())
+
+	genesis = testGenesis()
+	genesis.Alloc[0].Address = "abcd"
+	assert.NotNil(t, genesis.Validate())
+
+	genesis = testGenesis()
+	genesis.Validators = append(genesis.Validators, genesis.Validators[0])
+	assert.NotNil(t, genesis.Validate())
+
+	genesis = testGenesis()
+	genesis.Validators[0].Stake = 0
+	assert.NotNil(t, genesis.Validate())
+}
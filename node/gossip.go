@@ -0,0 +1,303 @@
+package node
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+)
+
+const (
+	// invFlushInterval is how often queued announcements are sent to peers
+	invFlushInterval = 100 * time.Millisecond
+	// maxInvBatch caps the items of a single inventory or getdata message
+	maxInvBatch = 1000
+	// maxKnownInventory caps the hashes remembered as known per peer
+	maxKnownInventory = 10000
+	// requestTimeout is how long an item requested from one peer is not
+	// requested from others
+	requestTimeout = 10 * time.Second
+)
+
+// knownInventory is a bounded set of hashes, once full the oldest hash is
+// forgotten for every new one.
+type knownInventory struct {
+	lock   sync.Mutex
+	hashes map[string]struct{}
+	order  []string
+	next   int
+}
+
+func newKnownInventory(size int) *knownInventory {
+	return &knownInventory{
+		hashes: make(map[string]struct{}, size),
+		order:  make([]string, 0, size),
+	}
+}
+
+// Add adds hash and reports whether it was unknown
+func (k *knownInventory) Add(hash string) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if _, ok := k.hashes[hash]; ok {
+		return false
+	}
+	if len(k.order) < cap(k.order) {
+		k.order = append(k.order, hash)
+	} else {
+		delete(k.hashes, k.order[k.next])
+		k.order[k.next] = hash
+		k.next = (k.next + 1) % len(k.order)
+	}
+	k.hashes[hash] = struct{}{}
+	return true
+}
+
+func (k *knownInventory) Has(hash string) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	_, ok := k.hashes[hash]
+	return ok
+}
+
+func (k *knownInventory) Len() int {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return len(k.hashes)
+}
+
+// queueInventory queues item for the next announcement to p, unless p is
+// known to have it already.
+func (p *remotePeer) queueInventory(item *proto.InvItem) {
+	if !p.known.Add(hex.EncodeToString(item.Hash)) {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pendingInv = append(p.pendingInv, item)
+}
+
+// takeInventory returns and clears the queued announcements of p
+func (p *remotePeer) takeInventory() []*proto.InvItem {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	items := p.pendingInv
+	p.pendingInv = nil
+	return items
+}
+
+// announce queues the hash of a transaction or block for all peers
+func (n *Node) announce(invType proto.InvType, hash []byte) {
+	item := &proto.InvItem{
+		Type: invType,
+		Hash: hash,
+	}
+	for _, p := range n.getPeers() {
+		p.queueInventory(item)
+	}
+}
+
+// gossipLoop sends the queued announcements to the peers in batches
+func (n *Node) gossipLoop() {
+	ticker := time.NewTicker(invFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := n.flushInventory(); err != nil {
+			n.logger.Debugw("announcing inventory failed", "we", n.ListenAddr, "err", err)
+		}
+	}
+}
+
+// flushInventory sends the queued announcements to every peer, a failing
+// peer does not keep the announcements from the others. The returned error
+// joins all failures.
+func (n *Node) flushInventory() error {
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		errs []error
+	)
+	for _, p := range n.getPeers() {
+		items := p.takeInventory()
+		if len(items) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(p *remotePeer) {
+			defer wg.Done()
+
+			for len(items) > 0 {
+				batch := items[:min(len(items), maxInvBatch)]
+				items = items[len(batch):]
+
+				err := p.stream.Send(&proto.Envelope{
+					Payload: &proto.Envelope_Inv{Inv: &proto.InvMessage{Items: batch}},
+				})
+				if err != nil {
+					lock.Lock()
+					errs = append(errs, fmt.Errorf("peer [%s]: %w", p.handshake.ListenAddr, err))
+					lock.Unlock()
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// handleInventory requests the items announced by the peer nodeID that we
+// lack and that are not requested from another peer already.
+func (n *Node) handleInventory(nodeID string, msg *proto.InvMessage) error {
+	p, err := n.connectedPeer(nodeID)
+	if err != nil {
+		return err
+	}
+	if len(msg.Items) > maxInvBatch {
+		err := reject(RejectMalformed, "inventory exceeds %d items", maxInvBatch)
+		n.rejected(nodeID, err)
+		return err
+	}
+
+	want := []*proto.InvItem{}
+	for _, item := range msg.Items {
+		if len(item.Hash) != 32 {
+			err := reject(RejectMalformed, "invalid inventory hash")
+			n.rejected(nodeID, err)
+			return err
+		}
+		hash := hex.EncodeToString(item.Hash)
+		// the peer has the item, so it never has to be announced to it
+		p.known.Add(hash)
+		if n.seen.Has(hash) || n.haveInventory(item) || !n.request(hash) {
+			continue
+		}
+		want = append(want, item)
+	}
+	if len(want) > 0 {
+		go n.fetchData(nodeID, p, want)
+	}
+	return nil
+}
+
+func (n *Node) getData(req *proto.GetDataRequest) (*proto.GetDataResponse, error) {
+	if len(req.Items) > maxInvBatch {
+		return nil, reject(RejectMalformed, "getdata exceeds %d items", maxInvBatch)
+	}
+
+	resp := &proto.GetDataResponse{}
+	for _, item := range req.Items {
+		hash := hex.EncodeToString(item.Hash)
+		switch item.Type {
+		case proto.InvType_INV_TX:
+			if tx, ok := n.mempool.Get(hash); ok {
+				resp.Transactions = append(resp.Transactions, tx)
+				continue
+			}
+		case proto.InvType_INV_BLOCK:
+			if b, err := n.chain.GetBlockByHash(item.Hash); err == nil {
+				resp.Blocks = append(resp.Blocks, b)
+				continue
+			}
+		}
+		resp.NotFound = append(resp.NotFound, item)
+	}
+	return resp, nil
+}
+
+// fetchData requests the announced items we lack from the peer that
+// announced them and processes what it returns.
+func (n *Node) fetchData(nodeID string, p *remotePeer, items []*proto.InvItem) {
+	defer func() {
+		for _, item := range items {
+			n.requestDone(hex.EncodeToString(item.Hash))
+		}
+	}()
+
+	reply, err := p.stream.Request(&proto.Envelope{
+		Payload: &proto.Envelope_GetData{GetData: &proto.GetDataRequest{Items: items}},
+	}, sendTimeout)
+	if err != nil {
+		n.logger.Debugw("getdata failed", "we", n.ListenAddr, "nodeID", nodeID, "err", err)
+		return
+	}
+	resp := reply.GetData_()
+	if resp == nil {
+		n.rejected(nodeID, reject(RejectMalformed, "getdata answered without data"))
+		return
+	}
+
+	requested := make(map[string]bool, len(items))
+	for _, item := range items {
+		requested[hex.EncodeToString(item.Hash)] = true
+	}
+	for _, tx := range resp.Transactions {
+		hash := types.HashTransaction(tx)
+		if !requested[hex.EncodeToString(hash)] {
+			continue
+		}
+		if err := n.processTransaction(tx); err != nil {
+			n.rejected(nodeID, err)
+		}
+	}
+	for _, b := range resp.Blocks {
+		hash := types.HashBlock(b)
+		if !requested[hex.EncodeToString(hash)] {
+			continue
+		}
+		if err := n.processBlock(b); err != nil {
+			n.rejected(nodeID, err)
+		}
+	}
+}
+
+// haveInventory reports whether we have the transaction or block of item
+func (n *Node) haveInventory(item *proto.InvItem) bool {
+	switch item.Type {
+	case proto.InvType_INV_TX:
+		_, ok := n.mempool.Get(hex.EncodeToString(item.Hash))
+		return ok
+	case proto.InvType_INV_BLOCK:
+		_, err := n.chain.GetBlockByHash(item.Hash)
+		return err == nil
+	default:
+		return true
+	}
+}
+
+// request marks hash as requested and reports whether it was not requested
+// from another peer within requestTimeout.
+func (n *Node) request(hash string) bool {
+	n.requestLock.Lock()
+	defer n.requestLock.Unlock()
+
+	now := time.Now()
+	if expires, ok := n.requested[hash]; ok && now.Before(expires) {
+		return false
+	}
+	n.requested[hash] = now.Add(requestTimeout)
+	return true
+}
+
+func (n *Node) requestDone(hash string) {
+	n.requestLock.Lock()
+	defer n.requestLock.Unlock()
+
+	delete(n.requested, hash)
+}
@@ -0,0 +1,95 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+	"github.com/dbkbali/blocker/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKnownInventory(t *testing.T) {
+	known := newKnownInventory(2)
+	assert.True(t, known.Add("a"))
+	assert.False(t, known.Add("a"))
+	assert.True(t, known.Add("b"))
+	assert.True(t, known.Add("c"))
+
+	// the oldest hash is forgotten
+	assert.Equal(t, 2, known.Len())
+	assert.False(t, known.Has("a"))
+	assert.True(t, known.Has("b"))
+	assert.True(t, known.Has("c"))
+	assert.True(t, known.Add("d"))
+	assert.False(t, known.Has("b"))
+}
+
+func TestQueueInventorySkipsKnown(t *testing.T) {
+	p := &remotePeer{known: newKnownInventory(maxKnownInventory)}
+	item := &proto.InvItem{Type: proto.InvType_INV_TX, Hash: util.RandomHash()}
+
+	p.queueInventory(item)
+	p.queueInventory(item)
+	assert.Equal(t, []*proto.InvItem{item}, p.takeInventory())
+	assert.Empty(t, p.takeInventory())
+
+	// items announced by the peer are not announced back
+	other := &proto.InvItem{Type: proto.InvType_INV_TX, Hash: util.RandomHash()}
+	p.known.Add(hex.EncodeToString(other.Hash))
+	p.queueInventory(other)
+	assert.Empty(t, p.takeInventory())
+}
+
+func TestInventoryGossip(t *testing.T) {
+	var (
+		a = makeTestNode(t, &DevnetParams)
+		b = makeTestNode(t, &DevnetParams)
+	)
+	connectTestNodes(t, a, b)
+
+	// the tx is submitted to a and fetched by b after a announced it
+	tx := randomTx()
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	_, err := proto.NewNodeClient(b.getPeers()[a.nodeID].conn).HandleTransaction(context.Background(), tx)
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool { return b.mempool.Has(tx) }, 2*time.Second, 10*time.Millisecond)
+
+	// both know the other has the tx, so b does not announce it back
+	assert.True(t, a.getPeers()[b.nodeID].known.Has(hash))
+	assert.True(t, b.getPeers()[a.nodeID].known.Has(hash))
+
+	resp, err := a.getData(&proto.GetDataRequest{Items: []*proto.InvItem{
+		{Type: proto.InvType_INV_TX, Hash: types.HashTransaction(tx)},
+		{Type: proto.InvType_INV_BLOCK, Hash: util.RandomHash()},
+	}})
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Transactions))
+	assert.Equal(t, 1, len(resp.NotFound))
+}
+
+func TestInventoryFromUnknownPeer(t *testing.T) {
+	var (
+		a = makeTestNode(t, &DevnetParams)
+		b = newTestNode(t, ServerConfig{Params: &DevnetParams})
+	)
+	conn, err := b.dialNode(a.ListenAddr)
+	require.Nil(t, err)
+	p := newRemotePeer(conn, &proto.HandshakeRequest{NodeId: a.nodeID})
+	go p.connect(b.nodeID, b.envelopeHandler(a.nodeID))
+	defer conn.Close()
+	defer p.stream.Close()
+
+	// b skipped the handshake, so a refuses its inventory
+	_, err = p.stream.Request(&proto.Envelope{
+		Payload: &proto.Envelope_Inv{Inv: &proto.InvMessage{
+			Items: []*proto.InvItem{{Type: proto.InvType_INV_TX, Hash: util.RandomHash()}},
+		}},
+	}, sendTimeout)
+	assert.NotNil(t, err)
+	assert.Empty(t, a.getPeers())
+}
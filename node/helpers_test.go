@@ -0,0 +1,60 @@
+package node
+
+import (
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+)
+
+// randomTx returns a transaction to a random address that is valid on a
+// devnet chain without blocks
+func randomTx() *proto.Transaction {
+	return genesisSpend(&DevnetParams, 0)
+}
+
+// genesisSpend returns a transaction spending the genesis output index of
+// params to a random address
+func genesisSpend(params *ChainParams, index uint32) *proto.Transaction {
+	privKey := crypto.NewPrivateKeyFromStringSeed(initSeed)
+	tx := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{{
+			PrevTxHash:   types.HashTransaction(params.Genesis.Block().Transactions[0]),
+			PrevOutIndex: index,
+			PublicKey:    privKey.Public().Bytes(),
+		}},
+		Outputs: []*proto.TxOutput{{
+			Amount:  99,
+			Address: crypto.GeneratePrivateKey().Public().Address().Bytes(),
+		}},
+	}
+	tx.Inputs[0].Signature = types.SignTransaction(privKey, tx).Bytes()
+	return tx
+}
+
+// fundedParams returns devnet params whose genesis funds the genesis key with
+// n outputs, so that a block can spend several of them
+func fundedParams(n int) *ChainParams {
+	params, _ := ParamsForNetwork(Devnet)
+	for len(params.Genesis.Alloc) < n {
+		params.Genesis.Alloc = append(params.Genesis.Alloc, params.Genesis.Alloc[0])
+	}
+	return params
+}
+
+// signedBlock returns a block with txx extending the genesis of params
+func signedBlock(params *ChainParams, txx ...*proto.Transaction) *proto.Block {
+	b := &proto.Block{
+		Header: &proto.Header{
+			Version:   blockVersion,
+			Height:    1,
+			PrevHash:  types.HashBlock(params.Genesis.Block()),
+			Timestamp: time.Now().UnixNano(),
+		},
+		Transactions: txx,
+	}
+	types.SignBlock(crypto.GeneratePrivateKey(), b)
+	return b
+}
@@ -0,0 +1,170 @@
+package node
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/util"
+	pb "github.com/golang/protobuf/proto"
+)
+
+const (
+	// challengeTTL is how long a handshake challenge can be answered
+	challengeTTL = 30 * time.Second
+	// challengeNonceLen is the length of handshake nonces
+	challengeNonceLen = 32
+	// maxChallenges caps the challenges waiting for an answer
+	maxChallenges = 10_000
+	// maxChallengesPerHost caps the challenges of a single host waiting for
+	// an answer
+	maxChallengesPerHost = 16
+)
+
+// LoadOrCreateNodeKey reads the identity key of the node from path, or
+// generates a new one and stores it there if the file does not exist yet.
+func LoadOrCreateNodeKey(path string) (*crypto.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != crypto.SeedLen {
+			return nil, fmt.Errorf("invalid node key [%s]", path)
+		}
+		return crypto.NewPrivateKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	privKey := crypto.GeneratePrivateKey()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(privKey.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return privKey, nil
+}
+
+// NodeID returns the id of the node owning pubKey
+func NodeID(pubKey *crypto.PublicKey) string {
+	return hex.EncodeToString(pubKey.Bytes())
+}
+
+// challenge is a nonce handed out to host
+type challenge struct {
+	nonce   string
+	host    string
+	expires time.Time
+}
+
+// Challenges keeps track of the nonces handed out to remote nodes, each of
+// them can be answered once before it expires. The number of pending
+// challenges is capped in total and per host.
+type Challenges struct {
+	lock sync.Mutex
+	// queue holds the pending challenges in the order they expire
+	queue  *list.List
+	nonces map[string]*list.Element
+	byHost map[string]int
+}
+
+func NewChallenges() *Challenges {
+	return &Challenges{
+		queue:  list.New(),
+		nonces: make(map[string]*list.Element),
+		byHost: make(map[string]int),
+	}
+}
+
+// New returns a fresh nonce for host
+func (c *Challenges) New(host string) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for elem := c.queue.Front(); elem != nil && now.After(elem.Value.(*challenge).expires); elem = c.queue.Front() {
+		c.remove(elem)
+	}
+	if len(c.nonces) >= maxChallenges || c.byHost[host] >= maxChallengesPerHost {
+		return nil, reject(RejectTooManyPeers, "too many pending handshake challenges")
+	}
+
+	nonce := util.RandomHash()
+	c.nonces[string(nonce)] = c.queue.PushBack(&challenge{
+		nonce:   string(nonce),
+		host:    host,
+		expires: now.Add(challengeTTL),
+	})
+	c.byHost[host]++
+	return nonce, nil
+}
+
+// Use consumes nonce and reports whether it was handed out and not expired
+func (c *Challenges) Use(nonce []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.nonces[string(nonce)]
+	if !ok {
+		return false
+	}
+	c.remove(elem)
+	return time.Now().Before(elem.Value.(*challenge).expires)
+}
+
+func (c *Challenges) remove(elem *list.Element) {
+	ch := c.queue.Remove(elem).(*challenge)
+	delete(c.nonces, ch.nonce)
+	if c.byHost[ch.host]--; c.byHost[ch.host] == 0 {
+		delete(c.byHost, ch.host)
+	}
+}
+
+func hashHandshake(h *proto.HandshakeRequest) []byte {
+	unsigned := pb.Clone(h).(*proto.HandshakeRequest)
+	unsigned.Signature = nil
+	b, err := pb.Marshal(unsigned)
+	if err != nil {
+		panic(err)
+	}
+	hash := sha256.Sum256(b)
+	return hash[:]
+}
+
+// signHandshake answers challenge with h and signs it with the identity key
+func signHandshake(privKey *crypto.PrivateKey, h *proto.HandshakeRequest, challenge []byte) {
+	h.NodeId = NodeID(privKey.Public())
+	h.Challenge = challenge
+	h.Signature = privKey.Sign(hashHandshake(h)).Bytes()
+}
+
+// verifyHandshakeSignature checks that h answers challenge and is signed by
+// the identity key matching its node id.
+func verifyHandshakeSignature(h *proto.HandshakeRequest, challenge []byte) error {
+	if !bytes.Equal(h.Challenge, challenge) {
+		return reject(RejectUnauthorized, "handshake does not answer our challenge")
+	}
+	pubKey, err := hex.DecodeString(h.NodeId)
+	if err != nil || len(pubKey) != crypto.PubKeyLen {
+		return reject(RejectUnauthorized, "invalid node id [%s]", h.NodeId)
+	}
+	if len(h.Signature) != crypto.SignatureLen {
+		return reject(RejectUnauthorized, "invalid handshake signature")
+	}
+	sig := crypto.SignatureFromBytes(h.Signature)
+	if !sig.Verify(hashHandshake(h), crypto.PublicKeyFromBytes(pubKey)) {
+		return reject(RejectUnauthorized, "invalid handshake signature")
+	}
+	return nil
+}
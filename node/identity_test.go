@@ -0,0 +1,76 @@
+package node
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateNodeKey(t *testing.T) {
+	// the directory of the key is created
+	path := filepath.Join(t.TempDir(), "keys", "node.key")
+
+	privKey, err := LoadOrCreateNodeKey(path)
+	require.Nil(t, err)
+
+	loaded, err := LoadOrCreateNodeKey(path)
+	require.Nil(t, err)
+	assert.Equal(t, privKey.Bytes(), loaded.Bytes())
+}
+
+func TestChallenges(t *testing.T) {
+	challenges := NewChallenges()
+	nonce, err := challenges.New("10.0.0.1")
+	require.Nil(t, err)
+	assert.Equal(t, challengeNonceLen, len(nonce))
+
+	assert.False(t, challenges.Use(util.RandomHash()))
+	assert.True(t, challenges.Use(nonce))
+	// a nonce can only be answered once
+	assert.False(t, challenges.Use(nonce))
+}
+
+func TestChallengesLimit(t *testing.T) {
+	challenges := NewChallenges()
+	nonces := [][]byte{}
+	for i := 0; i < maxChallengesPerHost; i++ {
+		nonce, err := challenges.New("10.0.0.1")
+		require.Nil(t, err)
+		nonces = append(nonces, nonce)
+	}
+	_, err := challenges.New("10.0.0.1")
+	assert.Equal(t, RejectTooManyPeers, RejectCodeOf(err))
+
+	// other hosts still get challenges, and answering one frees its slot
+	_, err = challenges.New("10.0.0.2")
+	assert.Nil(t, err)
+	assert.True(t, challenges.Use(nonces[0]))
+	_, err = challenges.New("10.0.0.1")
+	assert.Nil(t, err)
+}
+
+func TestSignVerifyHandshake(t *testing.T) {
+	var (
+		privKey   = crypto.GeneratePrivateKey()
+		challenge = util.RandomHash()
+		h         = &proto.HandshakeRequest{ListenAddr: ":3000"}
+	)
+	signHandshake(privKey, h, challenge)
+	assert.Equal(t, NodeID(privKey.Public()), h.NodeId)
+	assert.Nil(t, verifyHandshakeSignature(h, challenge))
+	assert.NotNil(t, verifyHandshakeSignature(h, util.RandomHash()))
+
+	// claiming the identity of another node
+	h.NodeId = NodeID(crypto.GeneratePrivateKey().Public())
+	assert.NotNil(t, verifyHandshakeSignature(h, challenge))
+
+	// tampering with the signed handshake
+	signHandshake(privKey, h, challenge)
+	h.ListenAddr = ":4000"
+	assert.NotNil(t, verifyHandshakeSignature(h, challenge))
+}
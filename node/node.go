@@ -1,8 +1,13 @@
 package node
 
 import (
+	"bytes"
+	"container/list"
 	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -10,22 +15,49 @@ import (
 	"github.com/dbkbali/blocker/crypto"
 	"github.com/dbkbali/blocker/proto"
 	"github.com/dbkbali/blocker/types"
+	"github.com/dbkbali/blocker/util"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/peer"
 )
 
-const blockTime = time.Second * 5
+// Limits of the mempool
+const (
+	// maxMempoolTxs caps the transactions in the mempool, the oldest one is
+	// dropped to make room for a new one
+	maxMempoolTxs = 10_000
+	// mempoolTxTTL is how long a transaction waits for a block before it is
+	// dropped
+	mempoolTxTTL = time.Hour
+)
 
+// Mempool holds the transactions waiting for a block. No two of them spend
+// the same output or issue the same asset.
 type Mempool struct {
 	lock sync.RWMutex
-	txx  map[string]*proto.Transaction
+	txx  map[string]*list.Element
+	// queue holds the transactions in the order they were added
+	queue *list.List
+	// spends maps the outpoints spent by the transactions to their hash
+	spends map[string]string
+	// issues maps the assets issued by the transactions to their hash
+	issues map[string]string
+}
+
+type mempoolTx struct {
+	tx    *proto.Transaction
+	hash  string
+	added time.Time
 }
 
 func NewMempool() *Mempool {
 	return &Mempool{
-		txx: make(map[string]*proto.Transaction),
+		txx:    make(map[string]*list.Element),
+		queue:  list.New(),
+		spends: make(map[string]string),
+		issues: make(map[string]string),
 	}
 }
 
@@ -33,13 +65,14 @@ func (pool *Mempool) Clear() []*proto.Transaction {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
-	txx := make([]*proto.Transaction, len(pool.txx))
-	iter := 0
-	for k, tx := range pool.txx {
-		delete(pool.txx, k)
-		txx[iter] = tx
-		iter++
+	txx := make([]*proto.Transaction, 0, len(pool.txx))
+	for elem := pool.queue.Front(); elem != nil; elem = elem.Next() {
+		txx = append(txx, elem.Value.(*mempoolTx).tx)
 	}
+	pool.txx = make(map[string]*list.Element)
+	pool.queue.Init()
+	pool.spends = make(map[string]string)
+	pool.issues = make(map[string]string)
 	return txx
 }
 
@@ -59,191 +92,882 @@ func (m *Mempool) Has(tx *proto.Transaction) bool {
 	return ok
 }
 
-func (m *Mempool) Add(tx *proto.Transaction) bool {
-	if m.Has(tx) {
-		return false
+// Get returns the transaction with the hex encoded hash
+func (m *Mempool) Get(hash string) (*proto.Transaction, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	elem, ok := m.txx[hash]
+	if !ok {
+		return nil, false
 	}
+	return elem.Value.(*mempoolTx).tx, true
+}
+
+// Transactions returns a snapshot of the transactions in the mempool, oldest
+// first
+func (m *Mempool) Transactions() []*proto.Transaction {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	txx := make([]*proto.Transaction, 0, len(m.txx))
+	for elem := m.queue.Front(); elem != nil; elem = elem.Next() {
+		txx = append(txx, elem.Value.(*mempoolTx).tx)
+	}
+	return txx
+}
+
+// RemoveBlockTransactions drops the transactions of b, which are confirmed
+// now, and the transactions conflicting with them, which can never be.
+func (m *Mempool) RemoveBlockTransactions(b *proto.Block) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, tx := range b.Transactions {
+		m.remove(hex.EncodeToString(types.HashTransaction(tx)))
+		for _, input := range tx.Inputs {
+			if hash, ok := m.spends[outpointKey(input)]; ok {
+				m.remove(hash)
+			}
+		}
+		if issuance := tx.Issuance; issuance != nil {
+			if hash, ok := m.issues[hex.EncodeToString(types.AssetID(issuance.PublicKey, issuance.Name))]; ok {
+				m.remove(hash)
+			}
+		}
+	}
+}
+
+// Remove drops txx from the mempool
+func (m *Mempool) Remove(txx []*proto.Transaction) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, tx := range txx {
+		m.remove(hex.EncodeToString(types.HashTransaction(tx)))
+	}
+}
+
+// Add adds tx to the mempool unless it is there already or conflicts with
+// one of its transactions. Expired transactions are dropped first.
+func (m *Mempool) Add(tx *proto.Transaction) error {
+	return m.add(tx, time.Now())
+}
 
+func (m *Mempool) add(tx *proto.Transaction, now time.Time) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	for elem := m.queue.Front(); elem != nil; elem = m.queue.Front() {
+		if now.Sub(elem.Value.(*mempoolTx).added) < mempoolTxTTL {
+			break
+		}
+		m.remove(elem.Value.(*mempoolTx).hash)
+	}
+
 	hash := hex.EncodeToString(types.HashTransaction(tx))
-	m.txx[hash] = tx
-	return true
+	if _, ok := m.txx[hash]; ok {
+		return reject(RejectDuplicate, "transaction [%s] is already in the mempool", hash)
+	}
+	for _, input := range tx.Inputs {
+		key := outpointKey(input)
+		if spender, ok := m.spends[key]; ok {
+			return reject(RejectDoubleSpend, "output [%s] is already spent by mempool transaction [%s]", key, spender)
+		}
+	}
+	var assetID string
+	if issuance := tx.Issuance; issuance != nil {
+		assetID = hex.EncodeToString(types.AssetID(issuance.PublicKey, issuance.Name))
+		if issuer, ok := m.issues[assetID]; ok {
+			return reject(RejectDuplicate, "asset [%s] is already issued by mempool transaction [%s]", assetID, issuer)
+		}
+	}
+
+	if len(m.txx) >= maxMempoolTxs {
+		m.remove(m.queue.Front().Value.(*mempoolTx).hash)
+	}
+	m.txx[hash] = m.queue.PushBack(&mempoolTx{tx: tx, hash: hash, added: now})
+	for _, input := range tx.Inputs {
+		m.spends[outpointKey(input)] = hash
+	}
+	if tx.Issuance != nil {
+		m.issues[assetID] = hash
+	}
+	return nil
 }
 
+func (m *Mempool) remove(hash string) {
+	elem, ok := m.txx[hash]
+	if !ok {
+		return
+	}
+	tx := m.queue.Remove(elem).(*mempoolTx).tx
+	delete(m.txx, hash)
+	for _, input := range tx.Inputs {
+		delete(m.spends, outpointKey(input))
+	}
+	if issuance := tx.Issuance; issuance != nil {
+		delete(m.issues, hex.EncodeToString(types.AssetID(issuance.PublicKey, issuance.Name)))
+	}
+}
+
+// outpointKey returns the key of the output spent by input, which is also
+// the key of its utxo
+func outpointKey(input *proto.TxInput) string {
+	return fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+}
+
+// Range of protocol versions spoken by this node
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 1
+	// maxVersionLen caps the software version a peer reports in its handshake
+	maxVersionLen = 64
+)
+
+// handshakeTimeout bounds the challenge and handshake calls to a remote node
+const handshakeTimeout = 10 * time.Second
+
 type ServerConfig struct {
 	Version    string
 	ListenAddr string
+	// PrivateKey signs blocks, only validators have one
 	PrivateKey *crypto.PrivateKey
+	// NodeKey is the identity of the node towards its peers, a new one is
+	// generated if nil
+	NodeKey *crypto.PrivateKey
+	// Params of the chain the node takes part in, mainnet if nil
+	Params *ChainParams
+	// AllowedPeers pins the node ids allowed to connect, any if empty
+	AllowedPeers []string
+	// Insecure disables TLS between nodes, it is only allowed on devnet
+	Insecure bool
+	// QueryAddr is where the Query service is served to clients, which do
+	// not need a node identity. It is not served if empty.
+	QueryAddr string
+	// AddrBookPath is where known peer addresses are persisted, they are only
+	// kept in memory if empty
+	AddrBookPath string
+	// TargetOutbound is the number of peers the node dials on its own
+	TargetOutbound int
+	// MaxInbound is the number of peers allowed to connect to the node
+	MaxInbound int
+	// BanListPath is where bans of misbehaving peers are persisted, they are
+	// only kept in memory if empty
+	BanListPath string
+	// BlockStore and TxStore keep the blocks and transactions of the chain,
+	// in memory if nil. Stores implementing io.Closer are closed on Stop.
+	BlockStore BlockStorer
+	TxStore    TXStorer
+	// AddressIndex enables address history queries and speeds up balance
+	// queries, the chain is indexed on Start. It is not maintained if nil.
+	AddressIndex AddressIndexer
 }
 
 type Node struct {
 	ServerConfig
-	logger *zap.SugaredLogger
+	logger      *zap.SugaredLogger
+	nodeID      string
+	genesisHash []byte
+	challenges  *Challenges
+	creds       credentials.TransportCredentials
+	addrBook    *AddrBook
+	banList     *BanList
 
 	peerLock sync.RWMutex
-	peers    map[proto.NodeClient]*proto.HandshakeRequest
-	mempool  *Mempool
+	// peers are keyed by node id
+	peers map[string]*remotePeer
+	// handshakes of inbound peers that did not open their stream yet
+	handshakes map[string]*pendingHandshake
+	// dialing holds the addresses with a dial in progress
+	dialing map[string]bool
+	mempool *Mempool
+	chain   *Chain
+	// seen suppresses processing and relaying the same hash twice
+	seen *SeenCache
+
+	// requested holds the expiry of getdata requests in flight by hash
+	requestLock sync.Mutex
+	requested   map[string]time.Time
+
+	// scores of misbehaving peers keyed by node id or host
+	scores *Scores
+
+	// ctx is cancelled when the node stops, which ends all background loops
+	ctx    context.Context
+	cancel context.CancelFunc
+	// loops tracks the background goroutines Stop waits for
+	loops  sync.WaitGroup
+	server *grpc.Server
+	// queryServer serves the Query service on QueryAddr
+	queryServer *grpc.Server
+	stopOnce    sync.Once
+	stopErr     error
 	proto.UnimplementedNodeServer
+	proto.UnimplementedAdminServer
+	proto.UnimplementedQueryServer
 }
 
 func NewNode(cfg ServerConfig) *Node {
 	loggerConfig := zap.NewDevelopmentConfig()
 	loggerConfig.EncoderConfig.TimeKey = ""
 	logger, _ := loggerConfig.Build()
+	if cfg.Params == nil {
+		cfg.Params, _ = ParamsForNetwork(Mainnet)
+	}
+	if cfg.NodeKey == nil {
+		cfg.NodeKey = crypto.GeneratePrivateKey()
+	}
+	if cfg.TargetOutbound == 0 {
+		cfg.TargetOutbound = defaultTargetOutbound
+	}
+	if cfg.MaxInbound == 0 {
+		cfg.MaxInbound = defaultMaxInbound
+	}
+	if cfg.BlockStore == nil {
+		cfg.BlockStore = NewMemoryBlockStore()
+	}
+	if cfg.TxStore == nil {
+		cfg.TxStore = NewMemoryTXStore()
+	}
+	addrBook, _ := NewAddrBook("")
+	banList, _ := NewBanList("")
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Node{
 		ServerConfig: cfg,
-		peers:        make(map[proto.NodeClient]*proto.HandshakeRequest),
+		nodeID:       NodeID(cfg.NodeKey.Public()),
+		genesisHash:  cfg.Params.Genesis.Hash(),
+		challenges:   NewChallenges(),
+		addrBook:     addrBook,
+		banList:      banList,
+		peers:        make(map[string]*remotePeer),
+		handshakes:   make(map[string]*pendingHandshake),
+		dialing:      make(map[string]bool),
 		logger:       logger.Sugar(),
 		mempool:      NewMempool(),
+		chain:        NewChain(cfg.Params, cfg.BlockStore, cfg.TxStore),
+		seen:         NewSeenCache(seenCacheSize, seenCacheTTL),
+		requested:    make(map[string]time.Time),
+		scores:       NewScores(),
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
+// Start serves the node on listenAddr and connects it to the network through
+// the bootstrap nodes. It returns once the node is running, which it keeps
+// doing until Stop is called.
 func (n *Node) Start(listenAddr string, bootstrapNodes []string) error {
 	n.ListenAddr = listenAddr
-	var (
-		opts       = []grpc.ServerOption{}
-		grpcServer = grpc.NewServer(opts...)
-	)
+	if err := n.setupTransport(); err != nil {
+		return err
+	}
+	addrBook, err := NewAddrBook(n.AddrBookPath)
+	if err != nil {
+		return err
+	}
+	n.addrBook = addrBook
+	banList, err := NewBanList(n.BanListPath)
+	if err != nil {
+		return err
+	}
+	n.banList = banList
+	if n.AddressIndex != nil {
+		if err := n.chain.SetAddressIndex(n.AddressIndex); err != nil {
+			return err
+		}
+	}
+	opts := []grpc.ServerOption{
+		grpc.Creds(n.creds),
+		grpc.UnaryInterceptor(n.accessInterceptor),
+		grpc.StreamInterceptor(n.streamAccessInterceptor),
+	}
 	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return err
 	}
-	proto.RegisterNodeServer(grpcServer, n)
+	n.server = grpc.NewServer(opts...)
+	proto.RegisterNodeServer(n.server, n)
+	proto.RegisterAdminServer(n.server, n)
 
+	n.spawn(func() {
+		if err := n.server.Serve(ln); err != nil {
+			n.logger.Errorw("serving failed", "we", n.ListenAddr, "err", err)
+		}
+	})
 	n.logger.Infow("node started...", "port:", n.ListenAddr)
 
-	// bootstrap network with known bootstrapNodes
-	if len(bootstrapNodes) > 0 {
-		go n.bootstrapNetwork(bootstrapNodes)
+	if len(n.QueryAddr) > 0 {
+		if err := n.serveQuery(); err != nil {
+			// the caller gets no running node to stop, so stop what
+			// has been started already
+			return errors.Join(err, n.Stop(context.Background()))
+		}
 	}
 
+	// bootstrap network with known bootstrapNodes
+	n.bootstrapNetwork(bootstrapNodes)
+
+	n.spawn(n.connectLoop)
+	n.spawn(n.healthLoop)
+	n.spawn(n.gossipLoop)
+
 	if n.PrivateKey != nil {
-		go n.validatorLoop()
+		n.spawn(n.validatorLoop)
 	}
+	return nil
+}
 
-	return grpcServer.Serve(ln)
+// Stop shuts the node down gracefully. It ends the background loops, closes
+// the streams and connections to all peers, lets in-flight calls finish and
+// flushes the stores. Calls still running once ctx expires are cancelled. A
+// stopped node can not be started again.
+func (n *Node) Stop(ctx context.Context) error {
+	n.stopOnce.Do(func() {
+		n.stopErr = n.stop(ctx)
+	})
+	return n.stopErr
 }
 
-func (n *Node) Handshake(ctx context.Context, req *proto.HandshakeRequest) (*proto.HandshakeRequest, error) {
-	c, err := makeNodeClient(req.ListenAddr)
+func (n *Node) stop(ctx context.Context) error {
+	n.cancel()
+
+	var wg sync.WaitGroup
+	for nodeID, p := range n.getPeers() {
+		wg.Add(1)
+		go func(nodeID string, p *remotePeer) {
+			defer wg.Done()
+			n.deletePeer(nodeID, p, "node stopping")
+		}(nodeID, p)
+	}
+	wg.Wait()
+
+	for _, server := range []*grpc.Server{n.server, n.queryServer} {
+		if server == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(server *grpc.Server) {
+			defer wg.Done()
+			stopServer(ctx, server)
+		}(server)
+	}
+	wg.Wait()
+
+	var errs []error
+	loopsDone := make(chan struct{})
+	go func() {
+		n.loops.Wait()
+		close(loopsDone)
+	}()
+	select {
+	case <-loopsDone:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("background loops still running: %w", ctx.Err()))
+	}
+
+	if err := n.addrBook.Save(); err != nil {
+		errs = append(errs, fmt.Errorf("saving address book: %w", err))
+	}
+	for _, store := range []any{n.BlockStore, n.TxStore} {
+		if closer, ok := store.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("closing store: %w", err))
+			}
+		}
+	}
+	n.logger.Infow("node stopped", "we", n.ListenAddr)
+	return errors.Join(errs...)
+}
+
+// stopServer stops server gracefully, cancelling the calls still running
+// once ctx expires.
+func stopServer(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
+
+// serveQuery serves the Query service on QueryAddr. Clients are not asked
+// for a certificate, so the service is reachable even if AllowedPeers pins
+// the peers of the node.
+func (n *Node) serveQuery() error {
+	creds := n.creds
+	if !n.Insecure {
+		var err error
+		if creds, err = NewQueryCredentials(n.NodeKey); err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("tcp", n.QueryAddr)
+	if err != nil {
+		return err
+	}
+	n.queryServer = grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.UnaryInterceptor(n.accessInterceptor),
+	)
+	proto.RegisterQueryServer(n.queryServer, n)
+
+	n.spawn(func() {
+		if err := n.queryServer.Serve(ln); err != nil {
+			n.logger.Errorw("serving queries failed", "we", n.QueryAddr, "err", err)
+		}
+	})
+	n.logger.Infow("serving queries", "we", n.ListenAddr, "addr", n.QueryAddr)
+	return nil
+}
+
+// spawn runs f in a goroutine that Stop waits for
+func (n *Node) spawn(f func()) {
+	n.loops.Add(1)
+	go func() {
+		defer n.loops.Done()
+		f()
+	}()
+}
+
+// setupTransport creates the credentials used between nodes, which are mutual
+// TLS bound to the node key unless insecure mode is enabled on devnet.
+func (n *Node) setupTransport() error {
+	if n.Insecure {
+		if n.Params.Name != Devnet {
+			return fmt.Errorf("insecure transport is only allowed on %s not on [%s]", Devnet, n.Params.Name)
+		}
+		n.logger.Warnw("running without transport security", "we", n.ListenAddr)
+		n.creds = insecure.NewCredentials()
+		return nil
+	}
+
+	creds, err := NewTransportCredentials(n.NodeKey, n.AllowedPeers)
+	if err != nil {
+		return err
+	}
+	n.creds = creds
+	return nil
+}
+
+func (n *Node) Challenge(ctx context.Context, req *proto.ChallengeRequest) (*proto.ChallengeResponse, error) {
+	p, _ := peer.FromContext(ctx)
+	_, host := peerTargets(p)
+	nonce, err := n.challenges.New(host)
 	if err != nil {
 		return nil, err
 	}
+	return &proto.ChallengeResponse{Nonce: nonce}, nil
+}
 
-	n.addPeer(c, req)
+func (n *Node) Handshake(ctx context.Context, req *proto.HandshakeRequest) (*proto.HandshakeRequest, error) {
+	p, _ := peer.FromContext(ctx)
+	if err := n.verifyRemoteHandshake(p, req); err != nil {
+		n.logger.Debugw("refused peer", "we", n.ListenAddr, "remoteNode", req.ListenAddr, "err", err)
+		return nil, err
+	}
 
-	return n.getHandshakeRequest(), nil
+	// the peer is added once it opens its stream
+	_, host := peerTargets(p)
+	if err := n.acceptHandshake(req, host); err != nil {
+		return nil, err
+	}
+	// addresses of inbound peers are counted per host, so that they cannot
+	// fill the address book with new identities
+	if addr, ok := inboundAddr(req.ListenAddr, host); ok {
+		n.addrBook.AddFrom(addr, host)
+	}
+
+	resp := n.getHandshakeRequest()
+	signHandshake(n.NodeKey, resp, req.Nonce)
+	return resp, nil
+}
+
+// verifyRemoteHandshake checks a handshake initiated by a remote node, which
+// has to answer a challenge we handed out and carry a nonce for our reply.
+func (n *Node) verifyRemoteHandshake(p *peer.Peer, req *proto.HandshakeRequest) error {
+	if !n.challenges.Use(req.Challenge) {
+		return reject(RejectUnauthorized, "unknown or expired handshake challenge")
+	}
+	if err := verifyHandshakeSignature(req, req.Challenge); err != nil {
+		return err
+	}
+	if err := n.verifyTransportIdentity(p, req.NodeId); err != nil {
+		return err
+	}
+	if n.banList.IsBanned(req.NodeId) {
+		return reject(RejectBanned, "node [%s] is banned", req.NodeId)
+	}
+	if len(req.Nonce) != challengeNonceLen {
+		return reject(RejectMalformed, "invalid handshake nonce")
+	}
+	return n.verifyHandshake(req)
+}
+
+// verifyTransportIdentity checks that the TLS certificate of the connection
+// to p belongs to the node id claimed in its handshake.
+func (n *Node) verifyTransportIdentity(p *peer.Peer, nodeID string) error {
+	if n.Insecure {
+		return nil
+	}
+	certNodeID, ok := tlsNodeID(p)
+	if !ok {
+		return reject(RejectUnauthorized, "connection without peer certificate")
+	}
+	if certNodeID != nodeID {
+		return reject(RejectUnauthorized, "certificate of node [%s] does not match node id [%s]", certNodeID, nodeID)
+	}
+	return nil
 }
 
 func (n *Node) HandleTransaction(ctx context.Context, tx *proto.Transaction) (*proto.Ack, error) {
 	peer, _ := peer.FromContext(ctx)
-	hash := hex.EncodeToString(types.HashTransaction(tx))
 
-	if n.mempool.Add(tx) {
-		n.logger.Debugw("Received tx", "from", peer.Addr, "hash", hash, "we", n.ListenAddr)
-		go func() {
-			if err := n.broadcast(tx); err != nil {
-				n.logger.Errorw("broadcast failure", "err", err)
-			}
-		}()
+	if err := n.processTransaction(tx); err != nil {
+		n.rejected(scoreTarget(peer), err)
+		return nil, err
 	}
+	return &proto.Ack{}, nil
+}
+
+func (n *Node) HandleBlock(ctx context.Context, b *proto.Block) (*proto.Ack, error) {
+	peer, _ := peer.FromContext(ctx)
 
+	if err := n.processBlock(b); err != nil {
+		n.rejected(scoreTarget(peer), err)
+		return nil, err
+	}
 	return &proto.Ack{}, nil
 }
 
+// processTransaction validates a received transaction against the chain and
+// announces it to our peers if it is new. Transactions seen recently are
+// ignored, even when they already left the mempool.
+func (n *Node) processTransaction(tx *proto.Transaction) error {
+	var (
+		hash    = types.HashTransaction(tx)
+		hashStr = hex.EncodeToString(hash)
+	)
+	if n.seen.Has(hashStr) {
+		return nil
+	}
+	if err := n.chain.ValidateTransaction(tx); err != nil {
+		return err
+	}
+	if !n.seen.Add(hashStr) {
+		return nil
+	}
+	if err := n.mempool.Add(tx); err != nil {
+		return err
+	}
+
+	n.logger.Debugw("Received tx", "hash", hashStr, "we", n.ListenAddr)
+	n.announce(proto.InvType_INV_TX, hash)
+	return nil
+}
+
+// processBlock adds a received block to the chain and relays it to our peers
+// if it is new. Blocks seen recently are ignored. A block is only seen once
+// it is part of the chain, so a block rejected for arriving before its
+// parent is taken when it arrives again.
+func (n *Node) processBlock(b *proto.Block) error {
+	var (
+		hash    = types.HashBlock(b)
+		hashStr = hex.EncodeToString(hash)
+	)
+	if n.seen.Has(hashStr) {
+		return nil
+	}
+	if err := CheckBlock(n.Params, b); err != nil {
+		return err
+	}
+	if err := n.chain.AddBlock(b); err != nil {
+		// the block was added while it was processed for another peer
+		if n.chain.HasBlock(hash) {
+			return nil
+		}
+		return err
+	}
+	n.seen.Add(hashStr)
+
+	n.mempool.RemoveBlockTransactions(b)
+	n.logger.Debugw("Received block", "hash", hashStr, "height", b.Header.Height, "we", n.ListenAddr)
+	n.relayBlock(b)
+	return nil
+}
+
+// rejected logs why data received from the peer with the score target from
+// was rejected and scores the rejections that are caused by misbehaviour.
+func (n *Node) rejected(from string, err error) {
+	code := RejectCodeOf(err)
+	n.logger.Debugw("rejected", "from", from, "code", code, "err", err, "we", n.ListenAddr)
+
+	if code.Misbehaving() {
+		n.misbehaved(from, code)
+	}
+}
+
 func (n *Node) validatorLoop() {
-	n.logger.Infow("starting validator loop", "pubkey", n.PrivateKey.Public(), "blockTime", blockTime)
+	blockTime := time.Duration(n.Params.BlockTime)
+	n.logger.Infow("starting validator loop", "pubkey", n.PrivateKey.Public(), "blockTime", blockTime, "network", n.Params.Name)
 	ticker := time.NewTicker(blockTime)
-	for {
-		<-ticker.C
+	defer ticker.Stop()
 
-		txx := n.mempool.Clear()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.produceBlock()
+	}
+}
 
-		n.logger.Debugw("time to create a new block", "lenTx", len(txx))
+// produceBlock signs a block of the transactions in the mempool that are
+// final at its height and timestamp and adds it to the chain. The others
+// stay in the mempool until they can be included, unless they never can.
+func (n *Node) produceBlock() {
+	b, invalid := n.chain.NewBlock(n.mempool.Transactions(), time.Now(), n.PrivateKey.Public().Address().Bytes())
+	n.mempool.Remove(invalid)
+	types.SignBlock(n.PrivateKey, b)
+
+	n.logger.Debugw("time to create a new block", "lenTx", len(b.Transactions), "height", b.Header.Height)
+	if err := n.processBlock(b); err != nil {
+		n.logger.Errorw("producing block failed", "we", n.ListenAddr, "height", b.Header.Height, "err", err)
 	}
+}
 
+// pendingHandshake is the handshake of an inbound peer waiting for its stream
+type pendingHandshake struct {
+	handshake *proto.HandshakeRequest
+	host      string
+	expires   time.Time
 }
-func (n *Node) broadcast(msg any) error {
-	n.peerLock.RLock()
-	defer n.peerLock.RUnlock()
 
-	for peer := range n.peers {
-		switch v := msg.(type) {
-		case *proto.Transaction:
-			_, err := peer.HandleTransaction(context.Background(), v)
-			if err != nil {
-				return err
-			}
+// acceptHandshake keeps the verified handshake of an inbound peer until the
+// peer opens its stream, which has to come from host within
+// handshakeTimeout. Pending handshakes count as inbound peers.
+func (n *Node) acceptHandshake(h *proto.HandshakeRequest, host string) error {
+	n.peerLock.Lock()
+	defer n.peerLock.Unlock()
+
+	now := time.Now()
+	for nodeID, pending := range n.handshakes {
+		if now.After(pending.expires) {
+			delete(n.handshakes, nodeID)
 		}
 	}
+	inbound := len(n.handshakes)
+	for _, p := range n.peers {
+		if !p.outbound {
+			inbound++
+		}
+	}
+	if inbound >= n.MaxInbound {
+		return reject(RejectTooManyPeers, "no more inbound peers allowed (%d)", n.MaxInbound)
+	}
+	n.handshakes[h.NodeId] = &pendingHandshake{
+		handshake: h,
+		host:      host,
+		expires:   now.Add(handshakeTimeout),
+	}
 	return nil
 }
 
-func (n *Node) addPeer(peer proto.NodeClient, handshake *proto.HandshakeRequest) {
+// takeHandshake returns and forgets the pending handshake of nodeID if it
+// was made from host.
+func (n *Node) takeHandshake(nodeID string, host string) (*proto.HandshakeRequest, bool) {
 	n.peerLock.Lock()
 	defer n.peerLock.Unlock()
 
-	//Logic to check if peer accepts or drop connection
+	pending, ok := n.handshakes[nodeID]
+	if !ok || pending.host != host || time.Now().After(pending.expires) {
+		return nil, false
+	}
+	delete(n.handshakes, nodeID)
+	return pending.handshake, true
+}
 
-	n.peers[peer] = handshake
+// addPeer adds p and reports whether it was added, the caller closes the
+// connection of p otherwise. When two nodes dial each other at once, both
+// keep the connection opened by the node with the smaller id.
+func (n *Node) addPeer(p *remotePeer) bool {
+	nodeID := p.handshake.NodeId
 
-	// connect to all Peers in the received peerList
-	if len(handshake.PeerList) > 0 {
-		go n.bootstrapNetwork(handshake.PeerList)
+	n.peerLock.Lock()
+	// no peers are added once the node is stopping
+	if n.ctx.Err() != nil {
+		n.peerLock.Unlock()
+		return false
+	}
+	replaced, ok := n.peers[nodeID]
+	if ok && n.initiator(nodeID, p) >= n.initiator(nodeID, replaced) {
+		n.peerLock.Unlock()
+		return false
+	}
+	n.peers[nodeID] = p
+	n.peerLock.Unlock()
+
+	if replaced != nil {
+		closePeer(replaced)
+	}
+	// inbound peers are served by the stream they opened
+	if p.outbound {
+		go n.runPeer(nodeID, p)
+		go n.monitorPeer(nodeID, p)
+		// only the peers we chose are asked for addresses, inbound peers
+		// could be anyone
+		go n.requestAddrs(nodeID, p)
 	}
 
 	n.logger.Debugw("new peer successfully connected",
 		"we", n.ListenAddr,
-		"remoteNode", handshake.ListenAddr,
-		"height", handshake.Height)
+		"remoteNode", p.handshake.ListenAddr,
+		"nodeID", nodeID,
+		"outbound", p.outbound,
+		"height", p.handshake.Height)
+	return true
+}
+
+// initiator returns the node id of the node that opened the connection to
+// the peer nodeID
+func (n *Node) initiator(nodeID string, p *remotePeer) string {
+	if p.outbound {
+		return n.nodeID
+	}
+	return nodeID
 }
 
-func (n *Node) deletePeer(peer proto.NodeClient) {
+// deletePeer drops p and closes its stream and connection, unless the node
+// id has been reconnected through another peer in the meantime.
+func (n *Node) deletePeer(nodeID string, p *remotePeer, reason string) {
 	n.peerLock.Lock()
-	defer n.peerLock.Unlock()
+	if n.peers[nodeID] != p {
+		n.peerLock.Unlock()
+		return
+	}
+	delete(n.peers, nodeID)
+	n.peerLock.Unlock()
 
-	delete(n.peers, peer)
+	closePeer(p)
+	n.logger.Debugw("peer disconnected",
+		"we", n.ListenAddr,
+		"remoteNode", p.handshake.ListenAddr,
+		"nodeID", nodeID,
+		"reason", reason)
 }
 
-func (n *Node) bootstrapNetwork(bootNodes []string) error {
-	for _, addr := range bootNodes {
-		if !n.canConnectWith(addr) {
-			continue
-		}
-		n.logger.Debugw("dialing remote node", "we", n.ListenAddr, "remote", addr)
-
-		c, h, err := n.dialRemoteNode(addr)
-		if err != nil {
-			return err
-		}
-		n.addPeer(c, h)
+func closePeer(p *remotePeer) {
+	p.stream.Close()
+	if p.conn != nil {
+		p.conn.Close()
 	}
-	return nil
 }
 
-func (n *Node) dialRemoteNode(addr string) (proto.NodeClient, *proto.HandshakeRequest, error) {
-	c, err := makeNodeClient(addr)
+func (n *Node) dialRemoteNode(addr string) (*grpc.ClientConn, *proto.HandshakeRequest, error) {
+	conn, err := n.dialNode(addr)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	h, err := c.Handshake(context.Background(), n.getHandshakeRequest())
+	h, err := n.handshake(proto.NewNodeClient(conn))
 	if err != nil {
+		conn.Close()
 		return nil, nil, err
 	}
+	return conn, h, nil
+}
+
+// handshake proves our identity to the node behind c and verifies its answer
+func (n *Node) handshake(c proto.NodeClient) (*proto.HandshakeRequest, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, handshakeTimeout)
+	defer cancel()
+
+	challenge, err := c.Challenge(ctx, &proto.ChallengeRequest{})
+	if err != nil {
+		return nil, err
+	}
 
-	return c, h, nil
+	req := n.getHandshakeRequest()
+	req.Nonce = util.RandomHash()
+	signHandshake(n.NodeKey, req, challenge.Nonce)
+
+	var p peer.Peer
+	h, err := c.Handshake(ctx, req, grpc.Peer(&p))
+	if err != nil {
+		return nil, err
+	}
+	// the remote node has to prove its identity by signing our nonce
+	if err := verifyHandshakeSignature(h, req.Nonce); err != nil {
+		return nil, err
+	}
+	if err := n.verifyTransportIdentity(&p, h.NodeId); err != nil {
+		return nil, err
+	}
+	if err := n.verifyHandshake(h); err != nil {
+		return nil, err
+	}
+
+	return h, nil
 }
 
 func (n *Node) getHandshakeRequest() *proto.HandshakeRequest {
 	return &proto.HandshakeRequest{
-		Version:    "blocker-01",
-		Height:     0,
-		ListenAddr: n.ListenAddr,
-		PeerList:   n.getPeerList(),
+		Version:            n.Version,
+		Height:             int32(n.chain.Height()),
+		ListenAddr:         n.ListenAddr,
+		Magic:              n.Params.Magic,
+		ChainId:            n.Params.Genesis.ChainID,
+		GenesisHash:        n.genesisHash,
+		MinProtocolVersion: minProtocolVersion,
+		MaxProtocolVersion: maxProtocolVersion,
+		NodeId:             n.nodeID,
+	}
+}
+
+// verifyHandshake checks that the remote node of h is on the same network
+// and speaks a common protocol version. Its software version is only logged,
+// so it merely has to be short and printable.
+func (n *Node) verifyHandshake(h *proto.HandshakeRequest) error {
+	if h.NodeId == n.nodeID {
+		return reject(RejectSelfConnection, "%w", ErrSelfConnection)
+	}
+	if h.Magic != n.Params.Magic {
+		return reject(RejectWrongNetwork, "network magic mismatch ours [%#x] theirs [%#x]", n.Params.Magic, h.Magic)
+	}
+	if h.ChainId != n.Params.Genesis.ChainID {
+		return reject(RejectWrongNetwork, "chain id mismatch ours [%s] theirs [%s]", n.Params.Genesis.ChainID, h.ChainId)
 	}
+	if !bytes.Equal(h.GenesisHash, n.genesisHash) {
+		return reject(RejectWrongNetwork, "genesis hash mismatch ours [%x] theirs [%x]", n.genesisHash, h.GenesisHash)
+	}
+	if !validVersion(h.Version) {
+		return reject(RejectMalformed, "invalid software version [%q]", h.Version)
+	}
+	if h.MinProtocolVersion > h.MaxProtocolVersion {
+		return reject(RejectIncompatibleVersion, "invalid protocol version range [%d, %d]", h.MinProtocolVersion, h.MaxProtocolVersion)
+	}
+	if h.MaxProtocolVersion < minProtocolVersion || h.MinProtocolVersion > maxProtocolVersion {
+		return reject(RejectIncompatibleVersion, "no common protocol version ours [%d, %d] theirs [%d, %d]",
+			minProtocolVersion, maxProtocolVersion, h.MinProtocolVersion, h.MaxProtocolVersion)
+	}
+	return nil
+}
+
+// validVersion reports whether v is a software version we are willing to log
+func validVersion(v string) bool {
+	if len(v) > maxVersionLen {
+		return false
+	}
+	for _, r := range v {
+		if r < ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
 }
 
 func (n *Node) canConnectWith(addr string) bool {
@@ -266,16 +990,12 @@ func (n *Node) getPeerList() []string {
 	defer n.peerLock.RUnlock()
 
 	peers := []string{}
-	for _, handshakeRequest := range n.peers {
-		peers = append(peers, handshakeRequest.ListenAddr)
+	for _, peer := range n.peers {
+		peers = append(peers, peer.handshake.ListenAddr)
 	}
 	return peers
 }
 
-func makeNodeClient(listenAddr string) (proto.NodeClient, error) {
-	conn, err := grpc.Dial(listenAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, err
-	}
-	return proto.NewNodeClient(conn), nil
+func (n *Node) dialNode(listenAddr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(listenAddr, grpc.WithTransportCredentials(n.creds))
 }
@@ -0,0 +1,535 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+	"github.com/dbkbali/blocker/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// freeAddr returns a local address with a free port
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func newTestConfig(t *testing.T, cfg ServerConfig) ServerConfig {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = freeAddr(t)
+	}
+	cfg.Version = "test"
+	return cfg
+}
+
+// newTestNode returns a node that is able to dial others without serving
+func newTestNode(t *testing.T, cfg ServerConfig) *Node {
+	n := NewNode(newTestConfig(t, cfg))
+	require.Nil(t, n.setupTransport())
+	return n
+}
+
+func makeTestNode(t *testing.T, params *ChainParams) *Node {
+	return startTestNode(t, ServerConfig{Params: params})
+}
+
+func startTestNode(t *testing.T, cfg ServerConfig) *Node {
+	n := NewNode(newTestConfig(t, cfg))
+	require.Nil(t, n.Start(n.ListenAddr, []string{}))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.Nil(t, n.Stop(ctx))
+	})
+	return n
+}
+
+func TestStartQueryAddrInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	n := NewNode(newTestConfig(t, ServerConfig{Params: &DevnetParams, QueryAddr: ln.Addr().String()}))
+	require.NotNil(t, n.Start(n.ListenAddr, []string{}))
+
+	// the node server is stopped, so its address can be reused
+	nodeLn, err := net.Listen("tcp", n.ListenAddr)
+	require.Nil(t, err)
+	nodeLn.Close()
+	assert.NotNil(t, n.ctx.Err())
+}
+
+func TestVerifyHandshake(t *testing.T) {
+	var (
+		a = NewNode(ServerConfig{Params: &DevnetParams})
+		b = NewNode(ServerConfig{Params: &DevnetParams})
+	)
+	assert.Nil(t, a.verifyHandshake(b.getHandshakeRequest()))
+	err := a.verifyHandshake(a.getHandshakeRequest())
+	assert.ErrorIs(t, err, ErrSelfConnection)
+	assert.Equal(t, RejectSelfConnection, RejectCodeOf(err))
+	assert.Equal(t, codes.Canceled, status.Code(err))
+	assert.False(t, IsRetryable(err))
+
+	h := b.getHandshakeRequest()
+	h.Magic = TestnetParams.Magic
+	assert.Equal(t, RejectWrongNetwork, RejectCodeOf(a.verifyHandshake(h)))
+
+	h = b.getHandshakeRequest()
+	h.ChainId = "other-1"
+	assert.Equal(t, RejectWrongNetwork, RejectCodeOf(a.verifyHandshake(h)))
+
+	h = b.getHandshakeRequest()
+	h.GenesisHash = make([]byte, 32)
+	assert.Equal(t, RejectWrongNetwork, RejectCodeOf(a.verifyHandshake(h)))
+
+	h = b.getHandshakeRequest()
+	h.Version = "0.0.1\n"
+	assert.Equal(t, RejectMalformed, RejectCodeOf(a.verifyHandshake(h)))
+	h.Version = strings.Repeat("1", maxVersionLen+1)
+	assert.Equal(t, RejectMalformed, RejectCodeOf(a.verifyHandshake(h)))
+
+	h = b.getHandshakeRequest()
+	h.MinProtocolVersion, h.MaxProtocolVersion = maxProtocolVersion+1, maxProtocolVersion+2
+	assert.Equal(t, RejectIncompatibleVersion, RejectCodeOf(a.verifyHandshake(h)))
+
+	h = b.getHandshakeRequest()
+	h.MinProtocolVersion, h.MaxProtocolVersion = 0, maxProtocolVersion+5
+	assert.Nil(t, a.verifyHandshake(h))
+}
+
+func TestHandshakeRefusesOtherNetwork(t *testing.T) {
+	var (
+		devnet  = makeTestNode(t, &DevnetParams)
+		testnet = newTestNode(t, ServerConfig{Params: &TestnetParams})
+		other   = newTestNode(t, ServerConfig{Params: &DevnetParams})
+	)
+
+	_, _, err := testnet.dialRemoteNode(devnet.ListenAddr)
+	require.NotNil(t, err)
+	assert.Equal(t, RejectWrongNetwork, RejectCodeOf(err))
+
+	_, h, err := other.dialRemoteNode(devnet.ListenAddr)
+	require.Nil(t, err)
+	assert.Equal(t, DevnetParams.Genesis.ChainID, h.ChainId)
+}
+
+func TestHandshakeIdentity(t *testing.T) {
+	var (
+		a = makeTestNode(t, &DevnetParams)
+		b = makeTestNode(t, &DevnetParams)
+	)
+
+	conn, h, err := b.dialRemoteNode(a.ListenAddr)
+	require.Nil(t, err)
+	assert.Equal(t, a.nodeID, h.NodeId)
+	c := proto.NewNodeClient(conn)
+
+	// a handshake without answering a challenge is refused
+	req := b.getHandshakeRequest()
+	req.Nonce = util.RandomHash()
+	signHandshake(b.NodeKey, req, util.RandomHash())
+	_, err = c.Handshake(context.Background(), req)
+	assert.Equal(t, RejectUnauthorized, RejectCodeOf(err))
+
+	// impersonating another node fails
+	challenge, err := c.Challenge(context.Background(), &proto.ChallengeRequest{})
+	require.Nil(t, err)
+	req = b.getHandshakeRequest()
+	req.Nonce = util.RandomHash()
+	signHandshake(crypto.GeneratePrivateKey(), req, challenge.Nonce)
+	req.NodeId = b.nodeID
+	_, err = c.Handshake(context.Background(), req)
+	assert.Equal(t, RejectUnauthorized, RejectCodeOf(err))
+
+	// b is added as peer once it opens its stream, peers are keyed by their
+	// node id
+	require.True(t, b.addPeer(newRemotePeer(conn, h)))
+	assert.Eventually(t, func() bool {
+		_, err := a.connectedPeer(b.nodeID)
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, len(a.getPeers()))
+
+	// the listen address of b is counted for its host
+	known, ok := a.addrBook.Get(b.ListenAddr)
+	require.True(t, ok)
+	assert.Equal(t, "127.0.0.1", known.Source)
+}
+
+// connectTestNodes makes b dial a and waits until a added b as inbound peer
+func connectTestNodes(t *testing.T, a, b *Node) {
+	b.dialPeer(a.ListenAddr)
+	_, err := b.connectedPeer(a.nodeID)
+	require.Nil(t, err)
+	require.Eventually(t, func() bool {
+		_, err := a.connectedPeer(b.nodeID)
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestInboundPeerUsesItsStream(t *testing.T) {
+	var (
+		a = makeTestNode(t, &DevnetParams)
+		b = makeTestNode(t, &DevnetParams)
+	)
+	connectTestNodes(t, a, b)
+
+	// a did not dial b back, it talks to b over the stream b opened
+	p, err := a.connectedPeer(b.nodeID)
+	require.Nil(t, err)
+	assert.False(t, p.outbound)
+	assert.Nil(t, p.conn)
+	_, err = p.ping()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, a.countPeers(true))
+}
+
+func TestDialEachOther(t *testing.T) {
+	var (
+		a  = makeTestNode(t, &DevnetParams)
+		b  = makeTestNode(t, &DevnetParams)
+		wg sync.WaitGroup
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.dialPeer(b.ListenAddr)
+	}()
+	go func() {
+		defer wg.Done()
+		b.dialPeer(a.ListenAddr)
+	}()
+	wg.Wait()
+
+	// both keep the connection opened by the node with the smaller id
+	aDialed := a.nodeID < b.nodeID
+	assert.Eventually(t, func() bool {
+		pa, errA := a.connectedPeer(b.nodeID)
+		pb, errB := b.connectedPeer(a.nodeID)
+		return errA == nil && errB == nil && pa.outbound == aDialed && pb.outbound == !aDialed
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, len(a.getPeers()))
+	assert.Equal(t, 1, len(b.getPeers()))
+}
+
+func TestInsecureTransportOnlyOnDevnet(t *testing.T) {
+	n := NewNode(ServerConfig{Params: &TestnetParams, Insecure: true})
+	assert.NotNil(t, n.setupTransport())
+
+	var (
+		a = startTestNode(t, ServerConfig{Params: &DevnetParams, Insecure: true})
+		b = newTestNode(t, ServerConfig{Params: &DevnetParams, Insecure: true})
+		c = newTestNode(t, ServerConfig{Params: &DevnetParams})
+	)
+	_, _, err := b.dialRemoteNode(a.ListenAddr)
+	assert.Nil(t, err)
+
+	// a TLS node does not talk to an insecure one
+	_, _, err = c.dialRemoteNode(a.ListenAddr)
+	assert.NotNil(t, err)
+}
+
+func TestPinnedPeers(t *testing.T) {
+	var (
+		allowed = newTestNode(t, ServerConfig{Params: &DevnetParams})
+		other   = newTestNode(t, ServerConfig{Params: &DevnetParams})
+		a       = startTestNode(t, ServerConfig{
+			Params:       &DevnetParams,
+			AllowedPeers: []string{allowed.nodeID},
+		})
+	)
+
+	_, _, err := other.dialRemoteNode(a.ListenAddr)
+	assert.NotNil(t, err)
+
+	_, _, err = allowed.dialRemoteNode(a.ListenAddr)
+	assert.Nil(t, err)
+}
+
+func TestReconnectFromAddrBook(t *testing.T) {
+	var (
+		a    = makeTestNode(t, &DevnetParams)
+		b    = newTestNode(t, ServerConfig{Params: &DevnetParams})
+		dead = freeAddr(t)
+	)
+	b.bootstrapNetwork([]string{dead, a.ListenAddr})
+	assert.Eventually(t, func() bool { return b.countPeers(true) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// the dead node is redialed with backoff
+	assert.Eventually(t, func() bool {
+		known, _ := b.addrBook.Get(dead)
+		return known.Failures == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	b.connectPeers()
+	assert.False(t, b.isDialing(dead))
+
+	// a dropped outbound peer is dialed again
+	for nodeID, p := range b.getPeers() {
+		b.deletePeer(nodeID, p, "test")
+	}
+	b.connectPeers()
+	assert.Eventually(t, func() bool { return b.countPeers(true) == 1 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestAddrExchange(t *testing.T) {
+	var (
+		a = makeTestNode(t, &DevnetParams)
+		b = makeTestNode(t, &DevnetParams)
+		c = makeTestNode(t, &DevnetParams)
+	)
+	c.dialPeer(a.ListenAddr)
+	require.Equal(t, 1, c.countPeers(true))
+
+	// b learns about c from a without dialing it on its own
+	b.dialPeer(a.ListenAddr)
+	assert.Eventually(t, func() bool {
+		known, ok := b.addrBook.Get(c.ListenAddr)
+		return ok && known.Source == a.nodeID
+	}, 2*time.Second, 10*time.Millisecond)
+	_, ok := b.addrBook.Get(b.ListenAddr)
+	assert.False(t, ok)
+	assert.Equal(t, 1, b.countPeers(true))
+
+	// addresses are only accepted as answer to our request
+	err := b.getPeers()[a.nodeID].stream.Send(&proto.Envelope{
+		Payload: &proto.Envelope_Addrs_{Addrs_: &proto.AddrsMessage{Addrs: []string{":1"}}},
+	})
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool { return a.score(b.nodeID) > 0 }, 2*time.Second, 10*time.Millisecond)
+	_, ok = a.addrBook.Get(":1")
+	assert.False(t, ok)
+}
+
+func TestValidAddr(t *testing.T) {
+	assert.True(t, validAddr(":3000"))
+	assert.True(t, validAddr("10.0.0.1:3000"))
+	assert.True(t, validAddr("[::1]:3000"))
+	assert.False(t, validAddr("10.0.0.1"))
+	assert.False(t, validAddr("10.0.0.1:0"))
+	assert.False(t, validAddr("10.0.0.1:70000"))
+	assert.False(t, validAddr("10.0.0.1:http"))
+}
+
+func TestInboundAddr(t *testing.T) {
+	addr, ok := inboundAddr(":3000", "10.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:3000", addr)
+	addr, ok = inboundAddr("10.0.0.1:3000", "10.0.0.1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:3000", addr)
+	addr, ok = inboundAddr("0.0.0.0:3000", "::1")
+	assert.True(t, ok)
+	assert.Equal(t, "[::1]:3000", addr)
+
+	// a peer cannot make us dial other hosts
+	_, ok = inboundAddr("10.0.0.2:3000", "10.0.0.1")
+	assert.False(t, ok)
+	_, ok = inboundAddr("example.com:3000", "10.0.0.1")
+	assert.False(t, ok)
+	_, ok = inboundAddr("10.0.0.1:0", "10.0.0.1")
+	assert.False(t, ok)
+}
+
+func TestProcessThroughChain(t *testing.T) {
+	var (
+		blocks = NewMemoryBlockStore()
+		n      = newTestNode(t, ServerConfig{Params: &DevnetParams, BlockStore: blocks})
+	)
+	// transactions have to spend outputs of the chain
+	err := n.processTransaction(genesisSpend(&DevnetParams, 1))
+	assert.Equal(t, RejectMissingInput, RejectCodeOf(err))
+	tx := randomTx()
+	require.Nil(t, n.processTransaction(tx))
+	assert.True(t, n.mempool.Has(tx))
+
+	// blocks have to extend the tip
+	orphan := signedBlock(&DevnetParams, tx)
+	orphan.Header.PrevHash = util.RandomHash()
+	types.SignBlock(crypto.GeneratePrivateKey(), orphan)
+	assert.Equal(t, RejectUnknownParent, RejectCodeOf(n.processBlock(orphan)))
+
+	block := signedBlock(&DevnetParams, tx)
+	require.Nil(t, n.processBlock(block))
+	assert.Equal(t, 1, n.chain.Height())
+	assert.Equal(t, int32(1), n.getHandshakeRequest().Height)
+	assert.False(t, n.mempool.Has(tx))
+	_, err = blocks.Get(hex.EncodeToString(types.HashBlock(block)))
+	assert.Nil(t, err)
+
+	// the genesis output is spent now
+	assert.Equal(t, RejectDoubleSpend, RejectCodeOf(n.processTransaction(randomTx())))
+}
+
+func TestProcessBlocksOutOfOrder(t *testing.T) {
+	var (
+		n      = newTestNode(t, ServerConfig{Params: &DevnetParams})
+		block1 = signedBlock(&DevnetParams)
+		block2 = signedBlock(&DevnetParams)
+	)
+	block2.Header.Height = 2
+	block2.Header.PrevHash = types.HashBlock(block1)
+	block2.Header.Timestamp = block1.Header.Timestamp + 1
+	types.SignBlock(crypto.GeneratePrivateKey(), block2)
+
+	// a block arriving before its parent is taken once the parent is there
+	assert.NotNil(t, n.processBlock(block2))
+	require.Nil(t, n.processBlock(block1))
+	require.Nil(t, n.processBlock(block2))
+	assert.Equal(t, 2, n.chain.Height())
+
+	// processing a block of the chain again is not an error
+	assert.Nil(t, n.processBlock(block1))
+}
+
+func TestProduceBlock(t *testing.T) {
+	var (
+		params    = fundedParams(2)
+		validator = crypto.GeneratePrivateKey()
+		n         = newTestNode(t, ServerConfig{Params: params, PrivateKey: validator})
+		spend     = genesisSpend(params, 0)
+		// spends the same output as spend
+		conflict   = genesisSpend(params, 0)
+		timelocked = genesisSpend(params, 1)
+		// spends an output of another chain
+		missing = genesisSpend(&TestnetParams, 0)
+	)
+	timelocked.LockTime = 3
+	timelocked.Inputs[0].Signature = types.SignTransaction(GenesisKey(), timelocked).Bytes()
+	require.Nil(t, n.processTransaction(spend))
+	assert.Equal(t, RejectDoubleSpend, RejectCodeOf(n.processTransaction(conflict)))
+	// transactions that are not valid for the next block are not accepted
+	// from peers
+	require.Nil(t, n.mempool.Add(timelocked))
+	require.Nil(t, n.mempool.Add(missing))
+
+	// the transaction that can never be included is dropped, the timelocked
+	// one waits for height 3
+	n.produceBlock()
+	require.Equal(t, 1, n.chain.Height())
+	b, err := n.chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	// the block reward is paid to the validator
+	coinbase := types.NewCoinbase(1, validator.Public().Address().Bytes(), params.Reward(1))
+	require.Len(t, b.Transactions, 2)
+	assert.Equal(t, types.HashTransaction(coinbase), types.HashTransaction(b.Transactions[0]))
+	assert.Equal(t, spend, b.Transactions[1])
+	assert.Equal(t, 1, n.mempool.Len())
+	assert.True(t, n.mempool.Has(timelocked))
+
+	n.produceBlock()
+	require.Equal(t, 2, n.chain.Height())
+	assert.Equal(t, 1, n.mempool.Len())
+
+	n.produceBlock()
+	b, err = n.chain.GetBlockByHeight(3)
+	require.Nil(t, err)
+	require.Len(t, b.Transactions, 2)
+	assert.Equal(t, timelocked, b.Transactions[1])
+	assert.Equal(t, 0, n.mempool.Len())
+
+	utxos, err := n.chain.GetUTXOsByAddress(validator.Public().Address().Bytes())
+	require.Nil(t, err)
+	assert.Len(t, utxos, 3)
+}
+
+func TestMempoolConflicts(t *testing.T) {
+	var (
+		params   = fundedParams(2)
+		n        = newTestNode(t, ServerConfig{Params: params})
+		spend    = genesisSpend(params, 0)
+		conflict = genesisSpend(params, 0)
+		other    = genesisSpend(params, 1)
+	)
+	require.Nil(t, n.processTransaction(spend))
+	require.Nil(t, n.processTransaction(other))
+	assert.Equal(t, RejectDoubleSpend, RejectCodeOf(n.mempool.Add(conflict)))
+	assert.Equal(t, RejectDuplicate, RejectCodeOf(n.mempool.Add(spend)))
+	assert.Equal(t, 2, n.mempool.Len())
+
+	// a block confirming the conflicting spend evicts the spend that can
+	// never be included, other is untouched
+	require.Nil(t, n.processBlock(signedBlock(params, conflict)))
+	assert.False(t, n.mempool.Has(spend))
+	assert.True(t, n.mempool.Has(other))
+	assert.Empty(t, n.mempool.spends[outpointKey(spend.Inputs[0])])
+}
+
+func TestMempoolLimits(t *testing.T) {
+	var (
+		mempool = NewMempool()
+		now     = time.Now()
+		first   = &proto.Transaction{Version: 1}
+	)
+	require.Nil(t, mempool.add(first, now))
+	for i := 1; i < maxMempoolTxs; i++ {
+		require.Nil(t, mempool.add(&proto.Transaction{Version: 1, LockTime: int64(i)}, now.Add(time.Minute)))
+	}
+	assert.Equal(t, maxMempoolTxs, mempool.Len())
+
+	// the oldest transaction makes room for a new one
+	require.Nil(t, mempool.add(&proto.Transaction{Version: 1, LockTime: maxMempoolTxs}, now.Add(time.Minute)))
+	assert.Equal(t, maxMempoolTxs, mempool.Len())
+	assert.False(t, mempool.Has(first))
+
+	// transactions waiting longer than mempoolTxTTL are dropped
+	require.Nil(t, mempool.add(first, now.Add(time.Minute+mempoolTxTTL)))
+	assert.Equal(t, 1, mempool.Len())
+}
+
+func TestStop(t *testing.T) {
+	var (
+		path = filepath.Join(t.TempDir(), "addrbook.json")
+		a    = makeTestNode(t, &DevnetParams)
+		b    = startTestNode(t, ServerConfig{Params: &DevnetParams, AddrBookPath: path})
+	)
+	b.dialPeer(a.ListenAddr)
+	require.Equal(t, 1, b.countPeers(true))
+	assert.Eventually(t, func() bool { return len(a.getPeers()) == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, b.Stop(ctx))
+	assert.Nil(t, b.Stop(ctx))
+
+	// b closed its peers, flushed its address book and stopped serving
+	assert.Empty(t, b.getPeers())
+	book, err := NewAddrBook(path)
+	require.Nil(t, err)
+	_, ok := book.Get(a.ListenAddr)
+	assert.True(t, ok)
+	assert.Eventually(t, func() bool { return len(a.getPeers()) == 0 }, 5*time.Second, 10*time.Millisecond)
+	_, _, err = a.dialRemoteNode(b.ListenAddr)
+	assert.NotNil(t, err)
+
+	// a stopped node accepts no peers
+	b.dialPeer(a.ListenAddr)
+	assert.Empty(t, b.getPeers())
+}
+
+func TestMaxInbound(t *testing.T) {
+	var (
+		a = startTestNode(t, ServerConfig{Params: &DevnetParams, MaxInbound: 1})
+		b = makeTestNode(t, &DevnetParams)
+		c = newTestNode(t, ServerConfig{Params: &DevnetParams})
+	)
+	_, _, err := b.dialRemoteNode(a.ListenAddr)
+	require.Nil(t, err)
+	_, _, err = c.dialRemoteNode(a.ListenAddr)
+	assert.Equal(t, RejectTooManyPeers, RejectCodeOf(err))
+	assert.True(t, IsRetryable(err))
+}
@@ -0,0 +1,211 @@
+package node
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/types"
+)
+
+// Names of the built-in networks
+const (
+	Mainnet = "mainnet"
+	Testnet = "testnet"
+	Devnet  = "devnet"
+)
+
+// Duration is a time.Duration encoded as a string like "5s" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ChainParams defines the network a node takes part in and the consensus
+// rules of its chain. Nodes only agree on the chain if their params match.
+type ChainParams struct {
+	Name  string `json:"name"`
+	Magic uint32 `json:"magic"`
+
+	Genesis Genesis `json:"genesis"`
+
+	BlockTime Duration `json:"blockTime"`
+	// BlockReward is the initial reward of a block, which is halved every
+	// HalvingInterval blocks. The validator claims it with the coinbase
+	// transaction of the block.
+	BlockReward     int64 `json:"blockReward"`
+	HalvingInterval int64 `json:"halvingInterval"`
+
+	MaxBlockSize int `json:"maxBlockSize"`
+	MaxBlockTxs  int `json:"maxBlockTxs"`
+	// MedianTimeBlocks is the number of recent blocks whose median timestamp
+	// a new block has to exceed
+	MedianTimeBlocks int `json:"medianTimeBlocks"`
+	// MaxFutureBlockTime is how far a block timestamp may be ahead of our clock
+	MaxFutureBlockTime Duration `json:"maxFutureBlockTime"`
+}
+
+// genesisKey is the key derived from initSeed, which holds the genesis
+// allocation and is the only validator of the testnet and devnet
+var genesisKey = crypto.NewPrivateKeyFromStringSeed(initSeed).Public()
+
+// mainnetGenesisKey holds the mainnet allocation and is its only validator.
+// Its private key is kept offline, it is not derived from initSeed.
+var mainnetGenesisKey = mustPublicKey("7e40deec49ba5665009811261f8e1ef48bd605b60f5a90a871f83cd1f82cbe64")
+
+// GenesisKey returns the private key of genesisKey. Its seed is part of the
+// source, so anyone can spend the testnet and devnet allocations with it.
+func GenesisKey() *crypto.PrivateKey {
+	return crypto.NewPrivateKeyFromStringSeed(initSeed)
+}
+
+func mustPublicKey(s string) *crypto.PublicKey {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return crypto.PublicKeyFromBytes(b)
+}
+
+func builtinGenesis(chainID string, timestamp int64, genesisKey *crypto.PublicKey) Genesis {
+	return Genesis{
+		ChainID:   chainID,
+		Timestamp: timestamp,
+		Alloc: []GenesisAlloc{
+			{Address: genesisKey.Address().String(), Amount: 1000},
+		},
+		Validators: []GenesisValidator{
+			{PublicKey: hex.EncodeToString(genesisKey.Bytes()), Stake: 1000},
+		},
+	}
+}
+
+var (
+	MainnetParams = ChainParams{
+		Name:               Mainnet,
+		Magic:              0xb10cce01,
+		Genesis:            builtinGenesis("blocker-mainnet", 1704067200, mainnetGenesisKey),
+		BlockTime:          Duration(5 * time.Second),
+		BlockReward:        50,
+		HalvingInterval:    210_000,
+		MaxBlockSize:       1 << 20,
+		MaxBlockTxs:        10_000,
+		MedianTimeBlocks:   11,
+		MaxFutureBlockTime: Duration(2 * time.Hour),
+	}
+
+	TestnetParams = ChainParams{
+		Name:               Testnet,
+		Magic:              0xb10cce02,
+		Genesis:            builtinGenesis("blocker-testnet", 1704067200, genesisKey),
+		BlockTime:          Duration(5 * time.Second),
+		BlockReward:        50,
+		HalvingInterval:    210_000,
+		MaxBlockSize:       1 << 20,
+		MaxBlockTxs:        10_000,
+		MedianTimeBlocks:   11,
+		MaxFutureBlockTime: Duration(2 * time.Hour),
+	}
+
+	DevnetParams = ChainParams{
+		Name:               Devnet,
+		Magic:              0xb10cce03,
+		Genesis:            builtinGenesis("blocker-devnet", 1704067200, genesisKey),
+		BlockTime:          Duration(time.Second),
+		BlockReward:        50,
+		HalvingInterval:    1_000,
+		MaxBlockSize:       1 << 20,
+		MaxBlockTxs:        10_000,
+		MedianTimeBlocks:   11,
+		MaxFutureBlockTime: Duration(2 * time.Hour),
+	}
+)
+
+// ParamsForNetwork returns a copy of the params of a built-in network
+func ParamsForNetwork(name string) (*ChainParams, error) {
+	var params ChainParams
+	switch name {
+	case Mainnet:
+		params = MainnetParams
+	case Testnet:
+		params = TestnetParams
+	case Devnet:
+		params = DevnetParams
+	default:
+		return nil, fmt.Errorf("unknown network [%s]", name)
+	}
+	params.Genesis.Alloc = append([]GenesisAlloc{}, params.Genesis.Alloc...)
+	params.Genesis.Validators = append([]GenesisValidator{}, params.Genesis.Validators...)
+	return &params, nil
+}
+
+// LoadChainParams reads custom chain params from a JSON file
+func LoadChainParams(path string) (*ChainParams, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	params := &ChainParams{}
+	if err := json.Unmarshal(b, params); err != nil {
+		return nil, fmt.Errorf("invalid chain params [%s]: %w", path, err)
+	}
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid chain params [%s]: %w", path, err)
+	}
+	return params, nil
+}
+
+// Validate checks that the params describe a usable chain
+func (p *ChainParams) Validate() error {
+	if len(p.Name) == 0 {
+		return fmt.Errorf("missing network name")
+	}
+	if err := p.Genesis.Validate(); err != nil {
+		return err
+	}
+	if p.BlockTime <= 0 {
+		return fmt.Errorf("block time must be positive")
+	}
+	if err := types.VerifyAmount(p.BlockReward); err != nil {
+		return fmt.Errorf("block reward: %w", err)
+	}
+	if p.HalvingInterval <= 0 {
+		return fmt.Errorf("halving interval must be positive")
+	}
+	if p.MaxBlockSize <= 0 || p.MaxBlockTxs <= 0 {
+		return fmt.Errorf("block limits must be positive")
+	}
+	if p.MedianTimeBlocks <= 0 {
+		return fmt.Errorf("median time blocks must be positive")
+	}
+	if p.MaxFutureBlockTime < 0 {
+		return fmt.Errorf("max future block time can not be negative")
+	}
+	return nil
+}
+
+// Reward returns the block reward at the given height
+func (p *ChainParams) Reward(height int64) int64 {
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return p.BlockReward >> halvings
+}
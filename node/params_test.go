@@ -0,0 +1,69 @@
+package node
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParamsForNetwork(t *testing.T) {
+	for _, name := range []string{Mainnet, Testnet, Devnet} {
+		params, err := ParamsForNetwork(name)
+		require.Nil(t, err)
+		assert.Equal(t, name, params.Name)
+		assert.Nil(t, params.Validate())
+	}
+
+	_, err := ParamsForNetwork("foonet")
+	assert.NotNil(t, err)
+}
+
+func TestLoadChainParams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "params.json")
+	require.Nil(t, os.WriteFile(path, []byte(`{
+		"name": "customnet",
+		"magic": 42,
+		"genesis": {
+			"chainId": "customnet-1",
+			"timestamp": 1704067200,
+			"alloc": [{"address": "`+genesisKey.Address().String()+`", "amount": 500}],
+			"validators": [{"publicKey": "`+hex.EncodeToString(genesisKey.Bytes())+`", "stake": 100}]
+		},
+		"blockTime": "2s",
+		"blockReward": 10,
+		"halvingInterval": 100,
+		"maxBlockSize": 1024,
+		"maxBlockTxs": 10,
+		"medianTimeBlocks": 3,
+		"maxFutureBlockTime": "1m"
+	}`), 0600))
+
+	params, err := LoadChainParams(path)
+	require.Nil(t, err)
+	assert.Equal(t, "customnet", params.Name)
+	assert.Equal(t, Duration(2*time.Second), params.BlockTime)
+	assert.Equal(t, Duration(time.Minute), params.MaxFutureBlockTime)
+
+	chain := NewChain(params, NewMemoryBlockStore(), NewMemoryTXStore())
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	assert.Equal(t, int64(500), genesis.Transactions[0].Outputs[0].Amount)
+
+	require.Nil(t, os.WriteFile(path, []byte(`{"name": "customnet", "blockTime": "2s"}`), 0600))
+	_, err = LoadChainParams(path)
+	assert.NotNil(t, err)
+}
+
+func TestReward(t *testing.T) {
+	params := &ChainParams{BlockReward: 50, HalvingInterval: 10}
+	assert.Equal(t, int64(50), params.Reward(0))
+	assert.Equal(t, int64(50), params.Reward(9))
+	assert.Equal(t, int64(25), params.Reward(10))
+	assert.Equal(t, int64(12), params.Reward(25))
+	assert.Equal(t, int64(0), params.Reward(10_000))
+}
@@ -0,0 +1,160 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/util"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	// pingInterval is how often connected peers are pinged
+	pingInterval = 10 * time.Second
+	// pingTimeout is how long a peer has to answer a ping
+	pingTimeout = 5 * time.Second
+	// maxPingFailures is the number of missed pings before a peer is dropped
+	maxPingFailures = 3
+	// sendTimeout bounds queueing and writing every message sent to a
+	// single peer
+	sendTimeout = 5 * time.Second
+)
+
+// remotePeer is a connected node that proved its identity in the handshake
+type remotePeer struct {
+	// conn is the connection to peers we dialed, inbound peers have none
+	// and are served over the stream they opened
+	conn   *grpc.ClientConn
+	client proto.NodeClient
+	// remoteAddr is the address the peer was dialed at or connected from
+	remoteAddr string
+	handshake  *proto.HandshakeRequest
+	// outbound is true for peers we dialed
+	outbound bool
+	// known holds the hashes of transactions and blocks the peer has
+	known *knownInventory
+	// stream carries all messages to the peer after the handshake
+	stream *peerStream
+
+	lock         sync.Mutex
+	pingFailures int
+	pendingInv   []*proto.InvItem
+}
+
+// newRemotePeer returns the outbound peer we dialed through conn
+func newRemotePeer(conn *grpc.ClientConn, handshake *proto.HandshakeRequest) *remotePeer {
+	return &remotePeer{
+		conn:       conn,
+		client:     proto.NewNodeClient(conn),
+		remoteAddr: conn.Target(),
+		handshake:  handshake,
+		outbound:   true,
+		known:      newKnownInventory(maxKnownInventory),
+		stream:     newPeerStream(context.Background()),
+	}
+}
+
+// newInboundPeer returns the peer that connected from remoteAddr, its stream
+// ends with ctx.
+func newInboundPeer(ctx context.Context, handshake *proto.HandshakeRequest, remoteAddr string) *remotePeer {
+	return &remotePeer{
+		remoteAddr: remoteAddr,
+		handshake:  handshake,
+		known:      newKnownInventory(maxKnownInventory),
+		stream:     newPeerStream(ctx),
+	}
+}
+
+// ping checks that the peer answers in time and returns the number of
+// consecutive failed pings.
+func (p *remotePeer) ping() (int, error) {
+	nonce := util.RandomHash()
+	resp, err := p.stream.Request(&proto.Envelope{
+		Payload: &proto.Envelope_Ping{Ping: &proto.PingRequest{Nonce: nonce}},
+	}, pingTimeout)
+	if err == nil && !bytes.Equal(resp.GetPong().GetNonce(), nonce) {
+		err = fmt.Errorf("ping answered with wrong nonce")
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err != nil {
+		p.pingFailures++
+		return p.pingFailures, err
+	}
+	p.pingFailures = 0
+	return 0, nil
+}
+
+// healthLoop pings all peers periodically and drops those that stopped
+// answering.
+func (n *Node) healthLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n.pingPeers()
+	}
+}
+
+func (n *Node) pingPeers() {
+	for nodeID, p := range n.getPeers() {
+		go func(nodeID string, p *remotePeer) {
+			failures, err := p.ping()
+			if err == nil {
+				return
+			}
+			n.logger.Debugw("ping failed", "we", n.ListenAddr, "nodeID", nodeID, "failures", failures, "err", err)
+			if failures >= maxPingFailures {
+				n.deletePeer(nodeID, p, "not answering pings")
+			}
+		}(nodeID, p)
+	}
+}
+
+// monitorPeer watches the connection to the outbound peer p and drops it once
+// the connection is shut down or fails and the peer does not answer a ping
+// anymore.
+func (n *Node) monitorPeer(nodeID string, p *remotePeer) {
+	for {
+		state := p.conn.GetState()
+		switch state {
+		case connectivity.Shutdown:
+			n.deletePeer(nodeID, p, "connection shut down")
+			return
+		case connectivity.TransientFailure:
+			if _, err := p.ping(); err != nil {
+				n.deletePeer(nodeID, p, "connection failed")
+				return
+			}
+		}
+		if !p.conn.WaitForStateChange(n.ctx, state) {
+			// the node is stopping
+			return
+		}
+	}
+}
+
+// getPeers returns a snapshot of the connected peers, so that they can be
+// contacted without holding the peer lock.
+func (n *Node) getPeers() map[string]*remotePeer {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	peers := make(map[string]*remotePeer, len(n.peers))
+	for nodeID, p := range n.peers {
+		peers[nodeID] = p
+	}
+	return peers
+}
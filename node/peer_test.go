@@ -0,0 +1,96 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDeadPeer returns a peer nobody is listening for, its stream is closed
+// as it could never be opened
+func newDeadPeer(t *testing.T, n *Node, nodeID string) *remotePeer {
+	conn, err := n.dialNode(freeAddr(t))
+	require.Nil(t, err)
+	p := newRemotePeer(conn, &proto.HandshakeRequest{NodeId: nodeID})
+	p.stream.Close()
+	return p
+}
+
+// addDeadPeer adds a dead peer to n, it is not monitored so it stays until
+// removed by the test
+func addDeadPeer(t *testing.T, n *Node) *remotePeer {
+	p := newDeadPeer(t, n, NodeID(crypto.GeneratePrivateKey().Public()))
+	n.peerLock.Lock()
+	n.peers[p.handshake.NodeId] = p
+	n.peerLock.Unlock()
+	return p
+}
+
+func TestPing(t *testing.T) {
+	var (
+		a = makeTestNode(t, &DevnetParams)
+		b = newTestNode(t, ServerConfig{Params: &DevnetParams})
+	)
+	conn, h, err := b.dialRemoteNode(a.ListenAddr)
+	require.Nil(t, err)
+	p := newRemotePeer(conn, h)
+	go p.connect(b.nodeID, b.envelopeHandler(a.nodeID))
+	defer p.stream.Close()
+
+	failures, err := p.ping()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, failures)
+}
+
+func TestDeadPeerIsRemoved(t *testing.T) {
+	n := newTestNode(t, ServerConfig{Params: &DevnetParams})
+
+	p := addDeadPeer(t, n)
+	for i := 0; i < maxPingFailures; i++ {
+		_, err := p.ping()
+		assert.NotNil(t, err)
+	}
+	n.pingPeers()
+	assert.Eventually(t, func() bool { return len(n.getPeers()) == 0 }, 2*time.Second, 10*time.Millisecond)
+
+	// closing the connection removes the peer as well
+	p = addDeadPeer(t, n)
+	go n.monitorPeer(p.handshake.NodeId, p)
+	p.conn.Close()
+	assert.Eventually(t, func() bool { return len(n.getPeers()) == 0 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFlushInventoryContinuesPastFailures(t *testing.T) {
+	var (
+		a = makeTestNode(t, &DevnetParams)
+		b = makeTestNode(t, &DevnetParams)
+	)
+	// the dead peer is not monitored, so it stays until the flush
+	dead := newDeadPeer(t, b, "dead")
+	dead.outbound = false
+	b.peerLock.Lock()
+	b.peers["dead"] = dead
+	b.peerLock.Unlock()
+
+	b.dialPeer(a.ListenAddr)
+	require.Equal(t, 1, b.countPeers(true))
+
+	tx := randomTx()
+	require.Nil(t, b.processTransaction(tx))
+	assert.Eventually(t, func() bool { return a.mempool.Has(tx) }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestFlushInventoryReportsFailures(t *testing.T) {
+	n := newTestNode(t, ServerConfig{Params: &DevnetParams})
+	n.peers["dead"] = newDeadPeer(t, n, "dead")
+
+	assert.Nil(t, n.flushInventory())
+	n.announce(proto.InvType_INV_TX, util.RandomHash())
+	assert.NotNil(t, n.flushInventory())
+	assert.Empty(t, n.peers["dead"].takeInventory())
+}
@@ -0,0 +1,177 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"sort"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// hashLen is the length of block and transaction hashes
+	hashLen = 32
+	// defaultHistoryLimit is the page size of address history and data
+	// queries without limit
+	defaultHistoryLimit = 100
+	// maxHistoryLimit caps the page size of address history and data queries
+	maxHistoryLimit = 1000
+)
+
+func (n *Node) GetBlockByHash(ctx context.Context, req *proto.GetBlockByHashRequest) (*proto.Block, error) {
+	if len(req.Hash) != hashLen {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid block hash length %d", len(req.Hash))
+	}
+	b, err := n.chain.GetBlockByHash(req.Hash)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "block [%x] not found", req.Hash)
+	}
+	return b, nil
+}
+
+func (n *Node) GetBlockByHeight(ctx context.Context, req *proto.GetBlockByHeightRequest) (*proto.Block, error) {
+	if req.Height < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative block height %d", req.Height)
+	}
+	b, err := n.chain.GetBlockByHeight(int(req.Height))
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "no block at height %d", req.Height)
+	}
+	return b, nil
+}
+
+// GetTransaction returns a transaction included in the chain, transactions
+// of the mempool are not served.
+func (n *Node) GetTransaction(ctx context.Context, req *proto.GetTransactionRequest) (*proto.Transaction, error) {
+	if len(req.Hash) != hashLen {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid transaction hash length %d", len(req.Hash))
+	}
+	tx, err := n.chain.GetTransaction(req.Hash)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "transaction [%x] not found", req.Hash)
+	}
+	return tx, nil
+}
+
+func (n *Node) GetUTXOsByAddress(ctx context.Context, req *proto.AddressRequest) (*proto.UTXOList, error) {
+	utxos, err := n.addressUTXOs(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	resp := &proto.UTXOList{}
+	for _, utxo := range utxos {
+		txHash, err := hex.DecodeString(utxo.Hash)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Utxos = append(resp.Utxos, &proto.UTXO{
+			TxHash:   txHash,
+			OutIndex: uint32(utxo.OutIndex),
+			Amount:   utxo.Amount,
+			Height:   int32(utxo.Height),
+			Htlc:     utxo.HTLC,
+			AssetId:  utxo.AssetID,
+		})
+	}
+	return resp, nil
+}
+
+// GetBalance sums the unspent outputs of an address per asset
+func (n *Node) GetBalance(ctx context.Context, req *proto.AddressRequest) (*proto.BalanceResponse, error) {
+	utxos, err := n.addressUTXOs(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		resp   = &proto.BalanceResponse{}
+		assets = map[string]int64{}
+	)
+	for _, utxo := range utxos {
+		if len(utxo.AssetID) == 0 {
+			resp.Amount += utxo.Amount
+			continue
+		}
+		assets[string(utxo.AssetID)] += utxo.Amount
+	}
+	for assetID, amount := range assets {
+		resp.Assets = append(resp.Assets, &proto.AssetBalance{AssetId: []byte(assetID), Amount: amount})
+	}
+	sort.Slice(resp.Assets, func(i, j int) bool {
+		return bytes.Compare(resp.Assets[i].AssetId, resp.Assets[j].AssetId) < 0
+	})
+	return resp, nil
+}
+
+func (n *Node) GetChainInfo(ctx context.Context, req *proto.ChainInfoRequest) (*proto.ChainInfo, error) {
+	height, tip := n.chain.Tip()
+	return &proto.ChainInfo{
+		ChainId:     n.Params.Genesis.ChainID,
+		GenesisHash: n.genesisHash,
+		Height:      int32(height),
+		TipHash:     types.HashHeader(tip),
+	}, nil
+}
+
+func (n *Node) GetAddressHistory(ctx context.Context, req *proto.AddressHistoryRequest) (*proto.AddressHistory, error) {
+	if len(req.Address) != crypto.AddressLen {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid address length %d", len(req.Address))
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "limit %d exceeds %d", limit, maxHistoryLimit)
+	}
+	txx, total, err := n.chain.AddressHistory(req.Address, int(req.Offset), limit)
+	if errors.Is(err, ErrNoAddressIndex) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &proto.AddressHistory{Total: uint32(total)}
+	for _, tx := range txx {
+		txHash, err := hex.DecodeString(tx.Hash)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		resp.Txs = append(resp.Txs, &proto.AddressTx{TxHash: txHash, Height: int32(tx.Height)})
+	}
+	return resp, nil
+}
+
+func (n *Node) FindTransactionsByDataPrefix(ctx context.Context, req *proto.DataPrefixRequest) (*proto.DataTransactions, error) {
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "limit %d exceeds %d", limit, maxHistoryLimit)
+	}
+	txx, total, err := n.chain.FindTransactionsByDataPrefix(req.Prefix, int(req.Offset), limit)
+	if errors.Is(err, ErrEmptyDataPrefix) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &proto.DataTransactions{Txs: txx, Total: uint32(total)}, nil
+}
+
+func (n *Node) addressUTXOs(address []byte) ([]*UTXO, error) {
+	if len(address) != crypto.AddressLen {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid address length %d", len(address))
+	}
+	utxos, err := n.chain.GetUTXOsByAddress(address)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return utxos, nil
+}
@@ -0,0 +1,161 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuery(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		params  = fundedParams(2)
+		n       = newTestNode(t, ServerConfig{Params: params})
+		address = genesisKey.Address().Bytes()
+		alloc   = params.Genesis.Alloc[0].Amount
+	)
+	balance, err := n.GetBalance(ctx, &proto.AddressRequest{Address: address})
+	require.Nil(t, err)
+	assert.Equal(t, 2*alloc, balance.Amount)
+
+	tx := genesisSpend(params, 0)
+	block := signedBlock(params, tx)
+	require.Nil(t, n.processBlock(block))
+
+	info, err := n.GetChainInfo(ctx, &proto.ChainInfoRequest{})
+	require.Nil(t, err)
+	assert.Equal(t, int32(1), info.Height)
+	assert.Equal(t, types.HashBlock(block), info.TipHash)
+	assert.Equal(t, params.Genesis.Hash(), info.GenesisHash)
+
+	b, err := n.GetBlockByHeight(ctx, &proto.GetBlockByHeightRequest{Height: 1})
+	require.Nil(t, err)
+	assert.Equal(t, block, b)
+	b, err = n.GetBlockByHash(ctx, &proto.GetBlockByHashRequest{Hash: info.TipHash})
+	require.Nil(t, err)
+	assert.Equal(t, block, b)
+
+	got, err := n.GetTransaction(ctx, &proto.GetTransactionRequest{Hash: types.HashTransaction(tx)})
+	require.Nil(t, err)
+	assert.Equal(t, tx, got)
+
+	// the spent genesis output is gone, the other one is left
+	utxos, err := n.GetUTXOsByAddress(ctx, &proto.AddressRequest{Address: address})
+	require.Nil(t, err)
+	require.Len(t, utxos.Utxos, 1)
+	assert.Equal(t, uint32(1), utxos.Utxos[0].OutIndex)
+	balance, err = n.GetBalance(ctx, &proto.AddressRequest{Address: address})
+	require.Nil(t, err)
+	assert.Equal(t, alloc, balance.Amount)
+
+	utxos, err = n.GetUTXOsByAddress(ctx, &proto.AddressRequest{Address: tx.Outputs[0].Address})
+	require.Nil(t, err)
+	require.Len(t, utxos.Utxos, 1)
+	assert.Equal(t, types.HashTransaction(tx), utxos.Utxos[0].TxHash)
+	assert.Equal(t, int32(1), utxos.Utxos[0].Height)
+}
+
+func TestQueryErrors(t *testing.T) {
+	var (
+		ctx = context.Background()
+		n   = newTestNode(t, ServerConfig{Params: &DevnetParams})
+	)
+	_, err := n.GetBlockByHeight(ctx, &proto.GetBlockByHeightRequest{Height: 1})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = n.GetBlockByHeight(ctx, &proto.GetBlockByHeightRequest{Height: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = n.GetTransaction(ctx, &proto.GetTransactionRequest{Hash: make([]byte, 32)})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = n.GetBlockByHash(ctx, &proto.GetBlockByHashRequest{Hash: []byte{1}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = n.GetBalance(ctx, &proto.AddressRequest{Address: make([]byte, crypto.AddressLen+1)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestQueryAddressHistory(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		address = genesisKey.Address().Bytes()
+		req     = &proto.AddressHistoryRequest{Address: address}
+	)
+	n := newTestNode(t, ServerConfig{Params: &DevnetParams})
+	_, err := n.GetAddressHistory(ctx, req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	n = startTestNode(t, ServerConfig{Params: &DevnetParams, AddressIndex: NewMemoryAddressIndex()})
+	tx := randomTx()
+	require.Nil(t, n.processBlock(signedBlock(&DevnetParams, tx)))
+
+	history, err := n.GetAddressHistory(ctx, req)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(2), history.Total)
+	require.Len(t, history.Txs, 2)
+	assert.Equal(t, types.HashTransaction(tx), history.Txs[0].TxHash)
+	assert.Equal(t, int32(1), history.Txs[0].Height)
+
+	history, err = n.GetAddressHistory(ctx, &proto.AddressHistoryRequest{Address: address, Offset: 1, Limit: 1})
+	require.Nil(t, err)
+	require.Len(t, history.Txs, 1)
+	assert.Equal(t, int32(0), history.Txs[0].Height)
+
+	_, err = n.GetAddressHistory(ctx, &proto.AddressHistoryRequest{Address: address, Limit: maxHistoryLimit + 1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestQueryDataPrefix(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		privKey = crypto.NewPrivateKeyFromStringSeed(initSeed)
+		n       = startTestNode(t, ServerConfig{Params: &DevnetParams})
+		tx      = randomTx()
+	)
+	tx.Outputs = append(tx.Outputs, &proto.TxOutput{Data: []byte("DOC:hello")})
+	tx.Inputs[0].Signature = types.SignTransaction(privKey, tx).Bytes()
+	require.Nil(t, n.processBlock(signedBlock(&DevnetParams, tx)))
+
+	resp, err := n.FindTransactionsByDataPrefix(ctx, &proto.DataPrefixRequest{Prefix: []byte("DOC:")})
+	require.Nil(t, err)
+	assert.Equal(t, uint32(1), resp.Total)
+	require.Len(t, resp.Txs, 1)
+	assert.Equal(t, types.HashTransaction(tx), types.HashTransaction(resp.Txs[0]))
+
+	resp, err = n.FindTransactionsByDataPrefix(ctx, &proto.DataPrefixRequest{Prefix: []byte("DOC:"), Offset: 1})
+	require.Nil(t, err)
+	assert.Equal(t, uint32(1), resp.Total)
+	assert.Len(t, resp.Txs, 0)
+
+	_, err = n.FindTransactionsByDataPrefix(ctx, &proto.DataPrefixRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = n.FindTransactionsByDataPrefix(ctx, &proto.DataPrefixRequest{Prefix: []byte("DOC:"), Limit: maxHistoryLimit + 1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestQueryWithoutClientCertificate(t *testing.T) {
+	n := startTestNode(t, ServerConfig{
+		Params:       &DevnetParams,
+		AllowedPeers: []string{NodeID(crypto.GeneratePrivateKey().Public())},
+		QueryAddr:    freeAddr(t),
+	})
+
+	conn, err := grpc.Dial(n.QueryAddr, grpc.WithTransportCredentials(NewQueryClientCredentials(n.nodeID)))
+	require.Nil(t, err)
+	defer conn.Close()
+	info, err := proto.NewQueryClient(conn).GetChainInfo(context.Background(), &proto.ChainInfoRequest{})
+	require.Nil(t, err)
+	assert.Equal(t, DevnetParams.Genesis.Hash(), info.GenesisHash)
+
+	// the query service is not served to peers
+	conn, err = grpc.Dial(n.ListenAddr, grpc.WithTransportCredentials(NewQueryClientCredentials(n.nodeID)))
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = proto.NewQueryClient(conn).GetChainInfo(context.Background(), &proto.ChainInfoRequest{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,92 @@
+package node
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// seenCacheSize is the number of transaction and block hashes remembered
+	seenCacheSize = 100_000
+	// seenCacheTTL is how long a processed hash suppresses processing it again
+	seenCacheTTL = 30 * time.Minute
+)
+
+type seenEntry struct {
+	hash    string
+	expires time.Time
+}
+
+// SeenCache remembers recently processed hashes. It is bounded in size,
+// evicting the least recently seen hash first, and in time since every hash
+// expires after its ttl.
+type SeenCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func NewSeenCache(size int, ttl time.Duration) *SeenCache {
+	return &SeenCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// Add marks hash as seen and reports whether it was not seen before or its
+// previous sighting expired.
+func (c *SeenCache) Add(hash string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if elem, ok := c.entries[hash]; ok {
+		entry := elem.Value.(*seenEntry)
+		expired := now.After(entry.expires)
+		entry.expires = now.Add(c.ttl)
+		c.lru.MoveToFront(elem)
+		return expired
+	}
+
+	c.entries[hash] = c.lru.PushFront(&seenEntry{
+		hash:    hash,
+		expires: now.Add(c.ttl),
+	})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return true
+}
+
+// Has reports whether hash was seen within the ttl
+func (c *SeenCache) Has(hash string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[hash]
+	if !ok {
+		return false
+	}
+	if time.Now().After(elem.Value.(*seenEntry).expires) {
+		c.remove(elem)
+		return false
+	}
+	return true
+}
+
+func (c *SeenCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *SeenCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*seenEntry).hash)
+}
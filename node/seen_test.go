@@ -0,0 +1,55 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeenCacheEviction(t *testing.T) {
+	c := NewSeenCache(2, time.Hour)
+	assert.True(t, c.Add("a"))
+	assert.False(t, c.Add("a"))
+	assert.True(t, c.Add("b"))
+
+	// a was seen last, so b is the least recently seen
+	assert.False(t, c.Add("a"))
+	assert.True(t, c.Add("c"))
+	assert.Equal(t, 2, c.Len())
+	assert.True(t, c.Has("a"))
+	assert.False(t, c.Has("b"))
+	assert.True(t, c.Has("c"))
+}
+
+func TestSeenCacheExpiry(t *testing.T) {
+	c := NewSeenCache(10, 20*time.Millisecond)
+	assert.True(t, c.Add("a"))
+	assert.True(t, c.Has("a"))
+
+	time.Sleep(30 * time.Millisecond)
+	assert.False(t, c.Has("a"))
+	assert.Equal(t, 0, c.Len())
+	assert.True(t, c.Add("a"))
+
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, c.Add("a"))
+}
+
+func TestSeenTransactionIsNotRelayedAgain(t *testing.T) {
+	n := newTestNode(t, ServerConfig{Params: &DevnetParams})
+	p := addDeadPeer(t, n)
+
+	tx := randomTx()
+	require.Nil(t, n.processTransaction(tx))
+	assert.Equal(t, 1, len(p.takeInventory()))
+
+	// the tx arrives again after the mempool was cleared for a block
+	n.mempool.Clear()
+	require.Nil(t, n.processTransaction(tx))
+	assert.Equal(t, 0, n.mempool.Len())
+	p.known = newKnownInventory(maxKnownInventory)
+	require.Nil(t, n.processTransaction(tx))
+	assert.Empty(t, p.takeInventory())
+}
@@ -1,8 +1,11 @@
 package node
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/dbkbali/blocker/proto"
@@ -12,11 +15,15 @@ import (
 type TXStorer interface {
 	Put(*proto.Transaction) error
 	Get(string) (*proto.Transaction, error)
+	Delete(string) error
 }
 
 type UTXOStorer interface {
 	Put(*UTXO) error
 	Get(string) (*UTXO, error)
+	Delete(string) error
+	// FindByAddress returns the outputs paying to address, spent or not
+	FindByAddress([]byte) ([]*UTXO, error)
 }
 
 type MemoryUTXOStore struct {
@@ -51,6 +58,27 @@ func (s *MemoryUTXOStore) Get(hash string) (*UTXO, error) {
 	return utxo, nil
 }
 
+func (s *MemoryUTXOStore) Delete(hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.data, hash)
+	return nil
+}
+
+func (s *MemoryUTXOStore) FindByAddress(address []byte) ([]*UTXO, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	utxos := []*UTXO{}
+	for _, utxo := range s.data {
+		if bytes.Equal(utxo.Address, address) {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos, nil
+}
+
 type MemoryTXStore struct {
 	lock sync.RWMutex
 	txx  map[string]*proto.Transaction
@@ -82,9 +110,18 @@ func (s *MemoryTXStore) Get(hash string) (*proto.Transaction, error) {
 	return tx, nil
 }
 
+func (s *MemoryTXStore) Delete(hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.txx, hash)
+	return nil
+}
+
 type BlockStorer interface {
 	Put(*proto.Block) error
 	Get(string) (*proto.Block, error)
+	Delete(string) error
 }
 
 type MemoryBlockStore struct {
@@ -115,3 +152,191 @@ func (m *MemoryBlockStore) Get(hash string) (*proto.Block, error) {
 	}
 	return block, nil
 }
+
+func (m *MemoryBlockStore) Delete(hash string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.blocks, hash)
+	return nil
+}
+
+// DataIndexer maps the payloads of data outputs to the hashes of the
+// transactions carrying them.
+type DataIndexer interface {
+	Put([]byte, string) error
+	Delete([]byte, string) error
+	FindByPrefix([]byte) ([]string, error)
+}
+
+type MemoryDataIndex struct {
+	lock sync.RWMutex
+	data map[string][]string
+}
+
+func NewMemoryDataIndex() *MemoryDataIndex {
+	return &MemoryDataIndex{
+		data: make(map[string][]string),
+	}
+}
+
+func (m *MemoryDataIndex) Put(data []byte, txHash string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := string(data)
+	m.data[key] = append(m.data[key], txHash)
+	return nil
+}
+
+func (m *MemoryDataIndex) Delete(data []byte, txHash string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := string(data)
+	hashes := m.data[key]
+	for i := len(hashes) - 1; i >= 0; i-- {
+		if hashes[i] == txHash {
+			hashes = append(hashes[:i:i], hashes[i+1:]...)
+			break
+		}
+	}
+	if len(hashes) == 0 {
+		delete(m.data, key)
+		return nil
+	}
+	m.data[key] = hashes
+	return nil
+}
+
+func (m *MemoryDataIndex) FindByPrefix(prefix []byte) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	keys := []string{}
+	for key := range m.data {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	hashes := []string{}
+	for _, key := range keys {
+		hashes = append(hashes, m.data[key]...)
+	}
+	return hashes, nil
+}
+
+// AddressTx is a transaction of the chain touching an address
+type AddressTx struct {
+	Hash string
+	// Height of the block that included the transaction
+	Height int
+}
+
+// AddressIndexer maps addresses to the outpoints paying to them, spent or
+// not, and to the transactions touching them in chain order.
+type AddressIndexer interface {
+	AddOutput(address []byte, outpoint string) error
+	RemoveOutput(address []byte, outpoint string) error
+	AddTransaction(address []byte, tx AddressTx) error
+	RemoveTransaction(address []byte, txHash string) error
+	Outputs(address []byte) ([]string, error)
+	// History returns up to limit transactions of address newest first,
+	// skipping the offset newest ones, and the number of transactions
+	History(address []byte, offset, limit int) ([]AddressTx, int, error)
+}
+
+type MemoryAddressIndex struct {
+	lock    sync.RWMutex
+	outputs map[string]map[string]struct{}
+	txx     map[string][]AddressTx
+}
+
+func NewMemoryAddressIndex() *MemoryAddressIndex {
+	return &MemoryAddressIndex{
+		outputs: make(map[string]map[string]struct{}),
+		txx:     make(map[string][]AddressTx),
+	}
+}
+
+func (m *MemoryAddressIndex) AddOutput(address []byte, outpoint string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := string(address)
+	if m.outputs[key] == nil {
+		m.outputs[key] = make(map[string]struct{})
+	}
+	m.outputs[key][outpoint] = struct{}{}
+	return nil
+}
+
+func (m *MemoryAddressIndex) RemoveOutput(address []byte, outpoint string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := string(address)
+	delete(m.outputs[key], outpoint)
+	if len(m.outputs[key]) == 0 {
+		delete(m.outputs, key)
+	}
+	return nil
+}
+
+func (m *MemoryAddressIndex) AddTransaction(address []byte, tx AddressTx) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := string(address)
+	m.txx[key] = append(m.txx[key], tx)
+	return nil
+}
+
+// RemoveTransaction removes the newest entry of txHash, transactions are
+// only removed when the tip is disconnected.
+func (m *MemoryAddressIndex) RemoveTransaction(address []byte, txHash string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := string(address)
+	txx := m.txx[key]
+	for i := len(txx) - 1; i >= 0; i-- {
+		if txx[i].Hash == txHash {
+			txx = append(txx[:i:i], txx[i+1:]...)
+			break
+		}
+	}
+	if len(txx) == 0 {
+		delete(m.txx, key)
+		return nil
+	}
+	m.txx[key] = txx
+	return nil
+}
+
+func (m *MemoryAddressIndex) Outputs(address []byte) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	outpoints := []string{}
+	for outpoint := range m.outputs[string(address)] {
+		outpoints = append(outpoints, outpoint)
+	}
+	sort.Strings(outpoints)
+	return outpoints, nil
+}
+
+func (m *MemoryAddressIndex) History(address []byte, offset, limit int) ([]AddressTx, int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var (
+		txx  = m.txx[string(address)]
+		page = []AddressTx{}
+	)
+	for i := len(txx) - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, txx[i])
+	}
+	return page, len(txx), nil
+}
@@ -0,0 +1,430 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dbkbali/blocker/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// streamQueueSize is the number of envelopes queued for a peer before
+	// senders block
+	streamQueueSize = 256
+	// streamCloseTimeout bounds sending the queued envelopes on close
+	streamCloseTimeout = 2 * time.Second
+	// nodeIDMetadataKey carries the node id of the caller on insecure
+	// connections, which have no certificate to identify it
+	nodeIDMetadataKey = "node-id"
+)
+
+var errStreamClosed = errors.New("peer stream closed")
+
+// envelopeStream is the side of a Connect stream held by a client or server
+type envelopeStream interface {
+	Send(*proto.Envelope) error
+	Recv() (*proto.Envelope, error)
+}
+
+// envelopeHandler handles an envelope received from the peer and returns the
+// reply if the envelope is a request.
+type envelopeHandler func(env *proto.Envelope) (*proto.Envelope, error)
+
+// peerStream multiplexes the messages to and from a peer over a single
+// Connect stream. Envelopes are sent in order by one writer from a bounded
+// queue, a full queue blocks senders for up to sendTimeout.
+type peerStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan *proto.Envelope
+	// closing stops accepting envelopes, those queued are still sent
+	closing   chan struct{}
+	closeOnce sync.Once
+	// done is closed once the stream ended
+	done     chan struct{}
+	doneOnce sync.Once
+
+	lock    sync.Mutex
+	started bool
+	nextID  uint64
+	// pending holds the requests waiting for a reply by id
+	pending map[uint64]chan *proto.Envelope
+}
+
+func newPeerStream(parent context.Context) *peerStream {
+	ctx, cancel := context.WithCancel(parent)
+	return &peerStream{
+		ctx:     ctx,
+		cancel:  cancel,
+		queue:   make(chan *proto.Envelope, streamQueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]chan *proto.Envelope),
+	}
+}
+
+// Send queues env for the peer. It fails if the queue stays full for
+// sendTimeout or the stream is closed.
+func (s *peerStream) Send(env *proto.Envelope) error {
+	select {
+	case <-s.closing:
+		return errStreamClosed
+	default:
+	}
+
+	timer := time.NewTimer(sendTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.queue <- env:
+		return nil
+	case <-s.closing:
+		return errStreamClosed
+	case <-timer.C:
+		return fmt.Errorf("send queue full for %s", sendTimeout)
+	}
+}
+
+// Request sends env and waits up to timeout for the reply of the peer. Errors
+// returned by the peer are converted back into a RejectError.
+func (s *peerStream) Request(env *proto.Envelope, timeout time.Duration) (*proto.Envelope, error) {
+	reply := make(chan *proto.Envelope, 1)
+
+	s.lock.Lock()
+	s.nextID++
+	env.Id = s.nextID
+	s.pending[env.Id] = reply
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, env.Id)
+		s.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if err := s.Send(env); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-reply:
+		if e := resp.GetError(); e != nil {
+			return nil, &RejectError{
+				Code: RejectCodeFromString(e.Code),
+				Err:  errors.New(e.Message),
+			}
+		}
+		return resp, nil
+	case <-s.done:
+		return nil, errStreamClosed
+	case <-timer.C:
+		return nil, fmt.Errorf("request %d timed out after %s", env.Id, timeout)
+	}
+}
+
+// Close stops accepting envelopes and waits for the queued ones to be sent
+// before the stream is ended, at most for streamCloseTimeout.
+func (s *peerStream) Close() {
+	s.closeOnce.Do(func() { close(s.closing) })
+
+	s.lock.Lock()
+	started := s.started
+	s.lock.Unlock()
+	if !started {
+		s.shutdown()
+		return
+	}
+
+	timer := time.NewTimer(streamCloseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.done:
+	case <-timer.C:
+		s.shutdown()
+	}
+}
+
+// run sends the queued envelopes on stream and dispatches the received ones
+// to handle until either side ends the stream. closeSend half closes the
+// stream of a client, it is nil for the server side.
+func (s *peerStream) run(stream envelopeStream, closeSend func() error, handle envelopeHandler) error {
+	s.lock.Lock()
+	select {
+	case <-s.closing:
+		s.lock.Unlock()
+		s.shutdown()
+		return errStreamClosed
+	default:
+	}
+	s.started = true
+	s.lock.Unlock()
+	defer s.shutdown()
+
+	var (
+		readErr   = make(chan error, 1)
+		writeDone = make(chan struct{})
+	)
+	go func() {
+		readErr <- s.readLoop(stream, handle)
+	}()
+	go func() {
+		defer close(writeDone)
+		s.writeLoop(stream, closeSend)
+	}()
+
+	select {
+	case err := <-readErr:
+		// replies queued before the peer ended its side are still sent
+		s.closeOnce.Do(func() { close(s.closing) })
+		timer := time.NewTimer(streamCloseTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-writeDone:
+		case <-timer.C:
+		}
+		return err
+	case <-writeDone:
+		if closeSend == nil {
+			return errStreamClosed
+		}
+		// the peer ends the stream once it read our half close
+		timer := time.NewTimer(streamCloseTimeout)
+		defer timer.Stop()
+
+		select {
+		case err := <-readErr:
+			return err
+		case <-timer.C:
+			return errStreamClosed
+		}
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *peerStream) writeLoop(stream envelopeStream, closeSend func() error) {
+	for {
+		select {
+		case env := <-s.queue:
+			if err := s.write(stream, env); err != nil {
+				return
+			}
+		case <-s.closing:
+			for {
+				select {
+				case env := <-s.queue:
+					if err := s.write(stream, env); err != nil {
+						return
+					}
+				default:
+					if closeSend != nil {
+						closeSend()
+					}
+					return
+				}
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// write sends env on stream. A peer not reading its stream blocks the send,
+// so the stream is cancelled if the send misses its deadline.
+func (s *peerStream) write(stream envelopeStream, env *proto.Envelope) error {
+	deadline := time.AfterFunc(sendTimeout, s.cancel)
+	defer deadline.Stop()
+
+	return stream.Send(env)
+}
+
+func (s *peerStream) readLoop(stream envelopeStream, handle envelopeHandler) error {
+	for {
+		env, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if env.ReplyTo != 0 {
+			s.deliver(env)
+			continue
+		}
+
+		reply, err := handle(env)
+		if env.Id == 0 {
+			// the handler reports failures of messages without reply
+			continue
+		}
+		if err != nil {
+			reply = errorEnvelope(err)
+		}
+		if reply == nil {
+			reply = &proto.Envelope{}
+		}
+		reply.ReplyTo = env.Id
+		if err := s.Send(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// deliver hands a reply to the request waiting for it, replies to unknown or
+// timed out requests are dropped.
+func (s *peerStream) deliver(env *proto.Envelope) {
+	s.lock.Lock()
+	reply, ok := s.pending[env.ReplyTo]
+	s.lock.Unlock()
+
+	if !ok {
+		return
+	}
+	select {
+	case reply <- env:
+	default:
+	}
+}
+
+func (s *peerStream) shutdown() {
+	s.closeOnce.Do(func() { close(s.closing) })
+	s.doneOnce.Do(func() { close(s.done) })
+	s.cancel()
+}
+
+func errorEnvelope(err error) *proto.Envelope {
+	return &proto.Envelope{
+		Payload: &proto.Envelope_Error{Error: &proto.EnvelopeError{
+			Code:    RejectCodeOf(err).String(),
+			Message: err.Error(),
+		}},
+	}
+}
+
+// connect opens the stream to p and serves it until it ends
+func (p *remotePeer) connect(nodeID string, handle envelopeHandler) error {
+	ctx := metadata.AppendToOutgoingContext(p.stream.ctx, nodeIDMetadataKey, nodeID)
+	stream, err := p.client.Connect(ctx)
+	if err != nil {
+		p.stream.shutdown()
+		return err
+	}
+	return p.stream.run(stream, stream.CloseSend, handle)
+}
+
+// runPeer serves the stream to p and drops p once the stream ended
+func (n *Node) runPeer(nodeID string, p *remotePeer) {
+	err := p.connect(n.nodeID, n.envelopeHandler(nodeID))
+	if err != nil && err != io.EOF {
+		n.logger.Debugw("peer stream ended", "we", n.ListenAddr, "nodeID", nodeID, "err", err)
+	}
+	n.deletePeer(nodeID, p, "stream closed")
+}
+
+// Connect serves the stream of an inbound peer, which has to complete the
+// handshake first. All messages to and from the peer go over the stream.
+func (n *Node) Connect(stream proto.Node_ConnectServer) error {
+	nodeID, ok := n.streamNodeID(stream.Context())
+	if !ok {
+		return reject(RejectUnauthorized, "stream without node id")
+	}
+	if n.banList.IsBanned(nodeID) {
+		return reject(RejectBanned, "node [%s] is banned", nodeID)
+	}
+	remote, _ := peer.FromContext(stream.Context())
+	_, host := peerTargets(remote)
+	h, ok := n.takeHandshake(nodeID, host)
+	if !ok {
+		return reject(RejectUnauthorized, "stream of node [%s] without handshake", nodeID)
+	}
+
+	p := newInboundPeer(stream.Context(), h, remote.Addr.String())
+	if !n.addPeer(p) {
+		return reject(RejectDuplicate, "node [%s] is already connected", nodeID)
+	}
+	err := p.stream.run(stream, nil, n.envelopeHandler(nodeID))
+	if err != nil && err != io.EOF && err != errStreamClosed {
+		n.logger.Debugw("inbound stream ended", "we", n.ListenAddr, "nodeID", nodeID, "err", err)
+	}
+	n.deletePeer(nodeID, p, "stream closed")
+	return nil
+}
+
+// streamNodeID returns the node id of the peer that opened the stream of
+// ctx, taken from its certificate or the metadata on insecure connections.
+func (n *Node) streamNodeID(ctx context.Context) (string, bool) {
+	p, _ := peer.FromContext(ctx)
+	if nodeID, ok := tlsNodeID(p); ok {
+		return nodeID, true
+	}
+	if !n.Insecure {
+		return "", false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	nodeIDs := md.Get(nodeIDMetadataKey)
+	if len(nodeIDs) != 1 {
+		return "", false
+	}
+	return nodeIDs[0], true
+}
+
+func (n *Node) envelopeHandler(nodeID string) envelopeHandler {
+	return func(env *proto.Envelope) (*proto.Envelope, error) {
+		return n.handleEnvelope(nodeID, env)
+	}
+}
+
+// handleEnvelope handles a message of the peer nodeID and returns the reply
+// to requests.
+func (n *Node) handleEnvelope(nodeID string, env *proto.Envelope) (*proto.Envelope, error) {
+	switch payload := env.Payload.(type) {
+	case *proto.Envelope_Ping:
+		return &proto.Envelope{
+			Payload: &proto.Envelope_Pong{Pong: &proto.PingResponse{Nonce: payload.Ping.Nonce}},
+		}, nil
+	case *proto.Envelope_Inv:
+		return nil, n.handleInventory(nodeID, payload.Inv)
+	case *proto.Envelope_GetData:
+		resp, err := n.getData(payload.GetData)
+		if err != nil {
+			return nil, err
+		}
+		return &proto.Envelope{Payload: &proto.Envelope_Data_{Data_: resp}}, nil
+	case *proto.Envelope_CompactBlock:
+		return nil, n.handleCompactBlock(nodeID, payload.CompactBlock)
+	case *proto.Envelope_GetBlockTxn:
+		resp, err := n.getBlockTxn(payload.GetBlockTxn)
+		if err != nil {
+			return nil, err
+		}
+		return &proto.Envelope{Payload: &proto.Envelope_BlockTxn_{BlockTxn_: resp}}, nil
+	case *proto.Envelope_GetAddrs:
+		return &proto.Envelope{Payload: &proto.Envelope_Addrs_{Addrs_: n.getAddrs()}}, nil
+	default:
+		err := reject(RejectMalformed, "unexpected message %T", env.Payload)
+		n.rejected(nodeID, err)
+		return nil, err
+	}
+}
+
+// connectedPeer returns the peer with nodeID or an error if it is not
+// connected, messages of unknown peers are not handled.
+func (n *Node) connectedPeer(nodeID string) (*remotePeer, error) {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	p, ok := n.peers[nodeID]
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "message from unknown peer [%s]", nodeID)
+	}
+	return p, nil
+}
@@ -0,0 +1,141 @@
+package node
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeStream is one end of an in memory envelope stream
+type pipeStream struct {
+	in        <-chan *proto.Envelope
+	out       chan<- *proto.Envelope
+	closeOnce sync.Once
+}
+
+func newPipe() (*pipeStream, *pipeStream) {
+	var (
+		a = make(chan *proto.Envelope, streamQueueSize)
+		b = make(chan *proto.Envelope, streamQueueSize)
+	)
+	return &pipeStream{in: a, out: b}, &pipeStream{in: b, out: a}
+}
+
+func (p *pipeStream) Send(env *proto.Envelope) error {
+	p.out <- env
+	return nil
+}
+
+func (p *pipeStream) Recv() (*proto.Envelope, error) {
+	env, ok := <-p.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return env, nil
+}
+
+func (p *pipeStream) CloseSend() error {
+	p.closeOnce.Do(func() { close(p.out) })
+	return nil
+}
+
+// serveStream runs s as the server side of pipe, ending the pipe once done
+// like gRPC does when a stream handler returns.
+func serveStream(s *peerStream, pipe *pipeStream, handle envelopeHandler) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.run(pipe, nil, handle)
+		pipe.CloseSend()
+	}()
+	return errc
+}
+
+func TestStreamRequestReply(t *testing.T) {
+	var (
+		clientPipe, serverPipe = newPipe()
+		client                 = newPeerStream(context.Background())
+		server                 = newPeerStream(context.Background())
+	)
+	serveStream(server, serverPipe, func(env *proto.Envelope) (*proto.Envelope, error) {
+		if ping := env.GetPing(); ping != nil {
+			return &proto.Envelope{Payload: &proto.Envelope_Pong{Pong: &proto.PingResponse{Nonce: ping.Nonce}}}, nil
+		}
+		return nil, reject(RejectMalformed, "unexpected message")
+	})
+	go client.run(clientPipe, clientPipe.CloseSend, nil)
+	defer client.Close()
+
+	nonce := util.RandomHash()
+	reply, err := client.Request(&proto.Envelope{
+		Payload: &proto.Envelope_Ping{Ping: &proto.PingRequest{Nonce: nonce}},
+	}, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, nonce, reply.GetPong().GetNonce())
+
+	// errors of the peer keep their reject code
+	_, err = client.Request(&proto.Envelope{Payload: &proto.Envelope_Inv{Inv: &proto.InvMessage{}}}, time.Second)
+	assert.Equal(t, RejectMalformed, RejectCodeOf(err))
+}
+
+func TestStreamSendBlocksWhenQueueFull(t *testing.T) {
+	s := newPeerStream(context.Background())
+	for i := 0; i < streamQueueSize; i++ {
+		require.Nil(t, s.Send(&proto.Envelope{}))
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Send(&proto.Envelope{})
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("send did not block on a full queue: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Close()
+	assert.Equal(t, errStreamClosed, <-errc)
+	assert.Equal(t, errStreamClosed, s.Send(&proto.Envelope{}))
+}
+
+func TestStreamCloseSendsQueued(t *testing.T) {
+	var (
+		clientPipe, serverPipe = newPipe()
+		client                 = newPeerStream(context.Background())
+		server                 = newPeerStream(context.Background())
+		lock                   sync.Mutex
+		received               int
+	)
+	errc := serveStream(server, serverPipe, func(env *proto.Envelope) (*proto.Envelope, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		received++
+		return nil, nil
+	})
+	go client.run(clientPipe, clientPipe.CloseSend, nil)
+
+	// the answered request shows the stream is running
+	_, err := client.Request(&proto.Envelope{}, time.Second)
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, client.Send(&proto.Envelope{Payload: &proto.Envelope_Inv{Inv: &proto.InvMessage{}}}))
+	}
+
+	// the envelopes queued before closing reach the peer, which then ends
+	// the stream
+	client.Close()
+	assert.Equal(t, io.EOF, <-errc)
+	lock.Lock()
+	assert.Equal(t, 11, received)
+	lock.Unlock()
+
+	_, err = client.Request(&proto.Envelope{}, time.Second)
+	assert.Equal(t, errStreamClosed, err)
+}
@@ -0,0 +1,152 @@
+package node
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/dbkbali/blocker/crypto"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// NewTLSCertificate returns a self-signed certificate for the ed25519 node
+// key. The certificate is bound to the node identity by its public key, so
+// peers identify each other by node id instead of a certificate authority.
+func NewTLSCertificate(nodeKey *crypto.PrivateKey) (tls.Certificate, error) {
+	var (
+		key    = ed25519.NewKeyFromSeed(nodeKey.Seed())
+		nodeID = NodeID(nodeKey.Public())
+		now    = time.Now()
+	)
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: nodeID},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// NewTransportCredentials returns mutual TLS credentials for the node key.
+// Both sides have to present a self-signed certificate of an ed25519 node
+// identity, which is restricted to allowedPeers if it is not empty.
+func NewTransportCredentials(nodeKey *crypto.PrivateKey, allowedPeers []string) (credentials.TransportCredentials, error) {
+	cert, err := NewTLSCertificate(nodeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := map[string]bool{}
+	for _, nodeID := range allowedPeers {
+		allowed[nodeID] = true
+	}
+
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// there is no certificate authority, the peer certificate is
+		// verified against its own key in verifyPeerCertificate instead
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerCertificate(allowed),
+	}), nil
+}
+
+// NewQueryCredentials returns TLS credentials for the node key which do not
+// ask clients for a certificate, as query clients have no node identity.
+func NewQueryCredentials(nodeKey *crypto.PrivateKey) (credentials.TransportCredentials, error) {
+	cert, err := NewTLSCertificate(nodeKey)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.NoClientCert,
+	}), nil
+}
+
+// NewQueryClientCredentials returns TLS credentials for querying the node
+// with the given node id without presenting a certificate.
+func NewQueryClientCredentials(nodeID string) credentials.TransportCredentials {
+	return credentials.NewTLS(&tls.Config{
+		MinVersion: tls.VersionTLS13,
+		// the server certificate is verified against the node id instead
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerCertificate(map[string]bool{nodeID: true}),
+	})
+}
+
+func verifyPeerCertificate(allowed map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) != 1 {
+			return fmt.Errorf("expected a single peer certificate got (%d)", len(rawCerts))
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+			return fmt.Errorf("peer certificate is not self-signed: %w", err)
+		}
+		now := time.Now()
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return fmt.Errorf("peer certificate is expired or not yet valid")
+		}
+		nodeID, err := nodeIDFromCertificate(cert)
+		if err != nil {
+			return err
+		}
+		if len(allowed) > 0 && !allowed[nodeID] {
+			return fmt.Errorf("peer [%s] is not allowed", nodeID)
+		}
+		return nil
+	}
+}
+
+func nodeIDFromCertificate(cert *x509.Certificate) (string, error) {
+	pubKey, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return "", fmt.Errorf("peer certificate without ed25519 key")
+	}
+	return hex.EncodeToString(pubKey), nil
+}
+
+// tlsNodeID returns the node id of the TLS certificate presented by p, ok is
+// false for insecure connections.
+func tlsNodeID(p *peer.Peer) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return "", false
+	}
+	nodeID, err := nodeIDFromCertificate(info.State.PeerCertificates[0])
+	if err != nil {
+		return "", false
+	}
+	return nodeID, true
+}
@@ -0,0 +1,27 @@
+package node
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTLSCertificate(t *testing.T) {
+	nodeKey := crypto.GeneratePrivateKey()
+	cert, err := NewTLSCertificate(nodeKey)
+	require.Nil(t, err)
+
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	require.Nil(t, err)
+	nodeID, err := nodeIDFromCertificate(x509Cert)
+	require.Nil(t, err)
+	assert.Equal(t, NodeID(nodeKey.Public()), nodeID)
+
+	assert.Nil(t, verifyPeerCertificate(nil)(cert.Certificate, nil))
+	assert.Nil(t, verifyPeerCertificate(map[string]bool{nodeID: true})(cert.Certificate, nil))
+	assert.NotNil(t, verifyPeerCertificate(map[string]bool{"other": true})(cert.Certificate, nil))
+	assert.NotNil(t, verifyPeerCertificate(nil)([][]byte{{1, 2, 3}}, nil))
+}
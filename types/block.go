@@ -28,12 +28,15 @@ func (t TxHash) Equals(other merkletree.Content) (bool, error) {
 	return equals, nil
 }
 
+// VerifyBlock checks that the transactions of b match its root hash and that
+// its header is signed by its public key.
 func VerifyBlock(b *proto.Block) bool {
-	if len(b.Transactions) > 0 {
-		if !VerifyRootHash(b) {
-			return false
-		}
-	}
+	return VerifyRootHash(b) && VerifyBlockSignature(b)
+}
+
+// VerifyBlockSignature only checks the signature of the header of b, its
+// transactions are not looked at.
+func VerifyBlockSignature(b *proto.Block) bool {
 	if len(b.PublicKey) != crypto.PubKeyLen {
 		return false
 	}
@@ -46,6 +49,8 @@ func VerifyBlock(b *proto.Block) bool {
 }
 
 func SignBlock(pk *crypto.PrivateKey, b *proto.Block) *crypto.Signature {
+	// a block without transactions has no root hash
+	b.Header.RootHash = nil
 	if len(b.Transactions) > 0 {
 		tree, err := GetMerkleTree(b)
 		if err != nil {
@@ -62,7 +67,12 @@ func SignBlock(pk *crypto.PrivateKey, b *proto.Block) *crypto.Signature {
 	return sig
 }
 
+// VerifyRootHash checks that the transactions of b match its root hash, which
+// has to be empty if b has no transactions.
 func VerifyRootHash(b *proto.Block) bool {
+	if len(b.Transactions) == 0 {
+		return len(b.Header.RootHash) == 0
+	}
 	tree, err := GetMerkleTree(b)
 	if err != nil {
 		return false
@@ -46,6 +46,21 @@ func TestSignVerifyBlock(t *testing.T) {
 	assert.False(t, VerifyBlock(block))
 }
 
+func TestVerifyBlockWithoutTransactions(t *testing.T) {
+	var (
+		privKey = crypto.GeneratePrivateKey()
+		block   = util.RandomBlock()
+	)
+	block.Transactions = append(block.Transactions, &proto.Transaction{Version: 1})
+	SignBlock(privKey, block)
+
+	// the header stays signed when the transactions are stripped
+	block.Transactions = nil
+	assert.True(t, VerifyBlockSignature(block))
+	assert.False(t, VerifyRootHash(block))
+	assert.False(t, VerifyBlock(block))
+}
+
 func TestHashBlock(t *testing.T) {
 	block := util.RandomBlock()
 	hash := HashBlock(block)
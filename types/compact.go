@@ -0,0 +1,47 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/dbkbali/blocker/proto"
+)
+
+// shortIDMask keeps the 6 bytes of a short transaction id
+const shortIDMask = 1<<48 - 1
+
+// ShortTxID returns the 6 byte short id of the transaction hash salted with
+// nonce. The salt keeps collisions from being crafted for every block.
+func ShortTxID(nonce uint64, txHash []byte) uint64 {
+	b := make([]byte, 8, 8+len(txHash))
+	binary.LittleEndian.PutUint64(b, nonce)
+	hash := sha256.Sum256(append(b, txHash...))
+	return binary.LittleEndian.Uint64(hash[:8]) & shortIDMask
+}
+
+// NewCompactBlock returns the compact form of b. The transactions for which
+// prefill returns true are sent in full, all others as short ids.
+func NewCompactBlock(b *proto.Block, nonce uint64, prefill func(tx *proto.Transaction) bool) *proto.CompactBlock {
+	cb := &proto.CompactBlock{
+		Header:    b.Header,
+		PublicKey: b.PublicKey,
+		Signature: b.Signature,
+		Nonce:     nonce,
+	}
+	for i, tx := range b.Transactions {
+		if prefill(tx) {
+			cb.Prefilled = append(cb.Prefilled, &proto.PrefilledTransaction{
+				Index:       uint32(i),
+				Transaction: tx,
+			})
+			continue
+		}
+		cb.ShortIds = append(cb.ShortIds, ShortTxID(nonce, HashTransaction(tx)))
+	}
+	return cb
+}
+
+// CompactBlockTxCount returns the number of transactions in the block of cb
+func CompactBlockTxCount(cb *proto.CompactBlock) int {
+	return len(cb.ShortIds) + len(cb.Prefilled)
+}
@@ -0,0 +1,39 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShortTxID(t *testing.T) {
+	hash := util.RandomHash()
+	assert.Equal(t, ShortTxID(1, hash), ShortTxID(1, hash))
+	assert.NotEqual(t, ShortTxID(1, hash), ShortTxID(2, hash))
+	assert.Less(t, ShortTxID(1, hash), uint64(1<<48))
+}
+
+func TestNewCompactBlock(t *testing.T) {
+	block := util.RandomBlock()
+	for i := 0; i < 3; i++ {
+		block.Transactions = append(block.Transactions, &proto.Transaction{
+			Version: int32(i),
+			Outputs: []*proto.TxOutput{{Amount: 1, Address: util.RandomHash()[:20]}},
+		})
+	}
+
+	cb := NewCompactBlock(block, 42, func(tx *proto.Transaction) bool {
+		return tx.Version == 1
+	})
+	assert.Equal(t, block.Header, cb.Header)
+	assert.Equal(t, uint64(42), cb.Nonce)
+	assert.Equal(t, 3, CompactBlockTxCount(cb))
+	assert.Equal(t, 1, len(cb.Prefilled))
+	assert.Equal(t, uint32(1), cb.Prefilled[0].Index)
+	assert.Equal(t, []uint64{
+		ShortTxID(42, HashTransaction(block.Transactions[0])),
+		ShortTxID(42, HashTransaction(block.Transactions[2])),
+	}, cb.ShortIds)
+}
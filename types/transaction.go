@@ -2,6 +2,8 @@ package types
 
 import (
 	"crypto/sha256"
+	"fmt"
+	"time"
 
 	"github.com/dbkbali/blocker/crypto"
 	"github.com/dbkbali/blocker/proto"
@@ -9,7 +11,7 @@ import (
 )
 
 func SignTransaction(pk *crypto.PrivateKey, tx *proto.Transaction) *crypto.Signature {
-	return pk.Sign(HashTransaction(tx))
+	return pk.Sign(hashUnsignedTransaction(tx))
 }
 
 func HashTransaction(tx *proto.Transaction) []byte {
@@ -21,18 +23,146 @@ func HashTransaction(tx *proto.Transaction) []byte {
 	return hash[:]
 }
 
+// hashUnsignedTransaction hashes tx with the signatures of all inputs
+// cleared, which is the message every input signs.
+func hashUnsignedTransaction(tx *proto.Transaction) []byte {
+	unsigned := pb.Clone(tx).(*proto.Transaction)
+	for _, input := range unsigned.Inputs {
+		input.Signature = nil
+	}
+	if unsigned.Issuance != nil {
+		unsigned.Issuance.Signature = nil
+	}
+	return HashTransaction(unsigned)
+}
+
+// AssetID returns the identifier of the asset with the given name issued
+// by the owner of pubKey.
+func AssetID(pubKey []byte, name string) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, pubKey...), name...))
+	return hash[:]
+}
+
 func VerifyTransaction(tx *proto.Transaction) bool {
+	hash := hashUnsignedTransaction(tx)
 	for _, input := range tx.Inputs {
-		if len(input.Signature) == 0 {
-			panic("signature is empty")
+		if len(input.Signature) != crypto.SignatureLen {
+			return false
+		}
+		if len(input.PublicKey) != crypto.PubKeyLen {
+			return false
 		}
 		sig := crypto.SignatureFromBytes(input.Signature)
 		pubKey := crypto.PublicKeyFromBytes(input.PublicKey)
-		// TODO: make sure no problems after verification due to sig being nil
-		input.Signature = nil
-		if !sig.Verify(HashTransaction(tx), pubKey) {
+		if !sig.Verify(hash, pubKey) {
+			return false
+		}
+	}
+	if issuance := tx.Issuance; issuance != nil {
+		if len(issuance.Signature) != crypto.SignatureLen {
+			return false
+		}
+		if len(issuance.PublicKey) != crypto.PubKeyLen {
+			return false
+		}
+		sig := crypto.SignatureFromBytes(issuance.Signature)
+		pubKey := crypto.PublicKeyFromBytes(issuance.PublicKey)
+		if !sig.Verify(hash, pubKey) {
 			return false
 		}
 	}
 	return true
 }
+
+// MaxMoney is the maximum amount of any asset that can ever exist, every
+// single amount and every sum of amounts has to stay within [0, MaxMoney].
+const MaxMoney int64 = 21_000_000 * 100_000_000
+
+// VerifyAmount checks that amount is within the valid money range
+func VerifyAmount(amount int64) error {
+	if amount < 0 {
+		return fmt.Errorf("negative amount (%d)", amount)
+	}
+	if amount > MaxMoney {
+		return fmt.Errorf("amount (%d) exceeds max money (%d)", amount, MaxMoney)
+	}
+	return nil
+}
+
+// AddAmounts returns a + b, failing if either of them or the sum is outside
+// of the valid money range. Since both amounts are at most MaxMoney the
+// addition itself can not overflow an int64.
+func AddAmounts(a, b int64) (int64, error) {
+	if err := VerifyAmount(a); err != nil {
+		return 0, err
+	}
+	if err := VerifyAmount(b); err != nil {
+		return 0, err
+	}
+	sum := a + b
+	if err := VerifyAmount(sum); err != nil {
+		return 0, err
+	}
+	return sum, nil
+}
+
+// MaxDataLen is the maximum payload size of a data output
+const MaxDataLen = 80
+
+// IsDataOutput reports whether output is an unspendable data output
+func IsDataOutput(output *proto.TxOutput) bool {
+	return len(output.Data) > 0
+}
+
+// VerifyDataOutput checks that a data output carries a bounded payload and
+// no value, so it can be left out of the UTXO set.
+func VerifyDataOutput(output *proto.TxOutput) error {
+	if len(output.Data) > MaxDataLen {
+		return fmt.Errorf("data output payload (%d) exceeds max length (%d)", len(output.Data), MaxDataLen)
+	}
+	if output.Amount != 0 {
+		return fmt.Errorf("data output must have zero amount")
+	}
+	if len(output.Address) > 0 || len(output.AssetId) > 0 || output.Htlc != nil {
+		return fmt.Errorf("data output can not have an address, asset or htlc")
+	}
+	return nil
+}
+
+// LockTimeThreshold separates the two interpretations of a transaction
+// lockTime. Values below it are block heights, values at or above it are
+// unix timestamps in seconds.
+const LockTimeThreshold = 500_000_000
+
+// IsFinalTransaction reports whether the absolute timelock of tx allows it
+// to be included in a block with the given height and timestamp (nanoseconds).
+func IsFinalTransaction(tx *proto.Transaction, height int64, timestamp int64) bool {
+	if tx.LockTime <= 0 {
+		return true
+	}
+	if tx.LockTime < LockTimeThreshold {
+		return height >= tx.LockTime
+	}
+	return timestamp/int64(time.Second) >= tx.LockTime
+}
+
+// IsCoinbase reports whether tx pays out the reward of a block
+func IsCoinbase(tx *proto.Transaction) bool {
+	return tx.CoinbaseHeight > 0
+}
+
+// NewCoinbase returns the coinbase transaction paying amount to address as
+// the reward of the block at height. The height makes the coinbase
+// transactions of different blocks distinct.
+func NewCoinbase(height int32, address []byte, amount int64) *proto.Transaction {
+	return &proto.Transaction{
+		Version:        1,
+		CoinbaseHeight: height,
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  amount,
+				Address: address,
+			},
+		},
+	}
+}
@@ -1,7 +1,9 @@
 package types
 
 import (
+	"math"
 	"testing"
+	"time"
 
 	"github.com/dbkbali/blocker/crypto"
 	"github.com/dbkbali/blocker/proto"
@@ -49,3 +51,81 @@ func TestNewTransaction(t *testing.T) {
 
 	assert.True(t, VerifyTransaction(tx))
 }
+
+func TestIsFinalTransaction(t *testing.T) {
+	now := time.Now()
+	tx := &proto.Transaction{
+		Version: 1,
+	}
+	assert.True(t, IsFinalTransaction(tx, 0, now.UnixNano()))
+
+	// locked by height
+	tx.LockTime = 10
+	assert.False(t, IsFinalTransaction(tx, 9, now.UnixNano()))
+	assert.True(t, IsFinalTransaction(tx, 10, now.UnixNano()))
+
+	// locked by timestamp
+	tx.LockTime = now.Add(time.Hour).Unix()
+	assert.False(t, IsFinalTransaction(tx, 1000, now.UnixNano()))
+	assert.True(t, IsFinalTransaction(tx, 1000, now.Add(time.Hour).UnixNano()))
+}
+
+func TestVerifyTransactionWithIssuance(t *testing.T) {
+	issuer := crypto.GeneratePrivateKey()
+	tx := &proto.Transaction{
+		Version: 1,
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  100,
+				Address: issuer.Public().Address().Bytes(),
+				AssetId: AssetID(issuer.Public().Bytes(), "GOLD"),
+			},
+		},
+		Issuance: &proto.AssetIssuance{
+			Name:      "GOLD",
+			Amount:    100,
+			PublicKey: issuer.Public().Bytes(),
+		},
+	}
+	assert.False(t, VerifyTransaction(tx))
+
+	tx.Issuance.Signature = SignTransaction(issuer, tx).Bytes()
+	assert.True(t, VerifyTransaction(tx))
+
+	tx.Issuance.PublicKey = crypto.GeneratePrivateKey().Public().Bytes()
+	assert.False(t, VerifyTransaction(tx))
+}
+
+func TestAddAmounts(t *testing.T) {
+	sum, err := AddAmounts(1, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), sum)
+
+	_, err = AddAmounts(-1, 2)
+	assert.NotNil(t, err)
+	_, err = AddAmounts(MaxMoney, 1)
+	assert.NotNil(t, err)
+	_, err = AddAmounts(math.MaxInt64, math.MaxInt64)
+	assert.NotNil(t, err)
+}
+
+func FuzzAddAmounts(f *testing.F) {
+	f.Add(int64(0), int64(0))
+	f.Add(int64(-1), int64(1))
+	f.Add(MaxMoney, int64(1))
+	f.Add(int64(math.MaxInt64), int64(math.MaxInt64))
+	f.Add(int64(math.MinInt64), int64(-1))
+
+	f.Fuzz(func(t *testing.T, a, b int64) {
+		sum, err := AddAmounts(a, b)
+		if err != nil {
+			return
+		}
+		if a < 0 || b < 0 || a > MaxMoney || b > MaxMoney {
+			t.Fatalf("accepted out of range amounts %d + %d", a, b)
+		}
+		if sum < a || sum < b || sum > MaxMoney {
+			t.Fatalf("invalid sum %d + %d = %d", a, b, sum)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/proto"
+	"github.com/dbkbali/blocker/types"
+	"github.com/dbkbali/blocker/util"
+)
+
+// Coin references an unspent output owned by the wallet
+type Coin struct {
+	TxHash   []byte
+	OutIndex uint32
+	Amount   int64
+}
+
+// NewSwapSecret returns a random preimage and the hash lock derived from it.
+// The preimage has to be kept secret until the swap is claimed.
+func NewSwapSecret() (preimage []byte, hashLock []byte) {
+	preimage = util.RandomHash()
+	hash := sha256.Sum256(preimage)
+	return preimage, hash[:]
+}
+
+// CreateSwap builds and signs a transaction that locks amount from coins in an
+// HTLC output. The recipient can claim it with the preimage of hashLock, the
+// sender gets it back from the block at timeoutHeight on. Any remaining value
+// is sent back to the sender as change.
+func CreateSwap(privKey *crypto.PrivateKey, coins []Coin, recipient crypto.Address, amount int64, hashLock []byte, timeoutHeight int64) (*proto.Transaction, error) {
+	if len(hashLock) != sha256.Size {
+		return nil, fmt.Errorf("invalid hash lock length must be %d bytes", sha256.Size)
+	}
+	if timeoutHeight <= 0 || timeoutHeight >= types.LockTimeThreshold {
+		return nil, fmt.Errorf("invalid timeout height (%d) must be in (0, %d)", timeoutHeight, types.LockTimeThreshold)
+	}
+
+	var (
+		sender = privKey.Public()
+		total  = int64(0)
+		inputs = make([]*proto.TxInput, len(coins))
+	)
+	for i, coin := range coins {
+		inputs[i] = &proto.TxInput{
+			PrevTxHash:   coin.TxHash,
+			PrevOutIndex: coin.OutIndex,
+			PublicKey:    sender.Bytes(),
+		}
+		total += coin.Amount
+	}
+	if total < amount {
+		return nil, fmt.Errorf("insufficient funds have (%d) need (%d)", total, amount)
+	}
+
+	outputs := []*proto.TxOutput{
+		{
+			Amount:  amount,
+			Address: recipient.Bytes(),
+			Htlc: &proto.HTLC{
+				HashLock:      hashLock,
+				RefundAddress: sender.Address().Bytes(),
+				TimeoutHeight: timeoutHeight,
+			},
+		},
+	}
+	if change := total - amount; change > 0 {
+		outputs = append(outputs, &proto.TxOutput{
+			Amount:  change,
+			Address: sender.Address().Bytes(),
+		})
+	}
+
+	tx := &proto.Transaction{
+		Version: 1,
+		Inputs:  inputs,
+		Outputs: outputs,
+	}
+	signTransaction(privKey, tx)
+	return tx, nil
+}
+
+// ClaimSwap builds and signs a transaction in which the recipient of the swap
+// reveals the preimage and moves the locked funds to its own address.
+func ClaimSwap(privKey *crypto.PrivateKey, swapTx *proto.Transaction, outIndex uint32, preimage []byte) (*proto.Transaction, error) {
+	output, err := htlcOutput(swapTx, outIndex)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(preimage)
+	if !bytes.Equal(hash[:], output.Htlc.HashLock) {
+		return nil, fmt.Errorf("preimage does not match hash lock")
+	}
+
+	tx := spendHTLC(privKey, swapTx, outIndex, output)
+	tx.Inputs[0].Preimage = preimage
+	signTransaction(privKey, tx)
+	return tx, nil
+}
+
+// RefundSwap builds and signs a transaction in which the sender of the swap
+// takes back the locked funds. The transaction is timelocked to the HTLC
+// timeout height so it can not be mined before the refund is allowed.
+func RefundSwap(privKey *crypto.PrivateKey, swapTx *proto.Transaction, outIndex uint32) (*proto.Transaction, error) {
+	output, err := htlcOutput(swapTx, outIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := spendHTLC(privKey, swapTx, outIndex, output)
+	// the timeout height is below LockTimeThreshold, so the lock time is
+	// read as a height as well
+	tx.LockTime = output.Htlc.TimeoutHeight
+	signTransaction(privKey, tx)
+	return tx, nil
+}
+
+func htlcOutput(swapTx *proto.Transaction, outIndex uint32) (*proto.TxOutput, error) {
+	if int(outIndex) >= len(swapTx.Outputs) {
+		return nil, fmt.Errorf("output [%d] does not exist", outIndex)
+	}
+	output := swapTx.Outputs[outIndex]
+	if output.Htlc == nil {
+		return nil, fmt.Errorf("output [%d] is not an htlc", outIndex)
+	}
+	return output, nil
+}
+
+func spendHTLC(privKey *crypto.PrivateKey, swapTx *proto.Transaction, outIndex uint32, output *proto.TxOutput) *proto.Transaction {
+	return &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash:   types.HashTransaction(swapTx),
+				PrevOutIndex: outIndex,
+				PublicKey:    privKey.Public().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  output.Amount,
+				Address: privKey.Public().Address().Bytes(),
+				AssetId: output.AssetId,
+			},
+		},
+	}
+}
+
+func signTransaction(privKey *crypto.PrivateKey, tx *proto.Transaction) {
+	sig := types.SignTransaction(privKey, tx)
+	for _, input := range tx.Inputs {
+		input.Signature = sig.Bytes()
+	}
+}
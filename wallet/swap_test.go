@@ -0,0 +1,71 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/dbkbali/blocker/crypto"
+	"github.com/dbkbali/blocker/types"
+	"github.com/dbkbali/blocker/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSwap(t *testing.T) {
+	var (
+		sender      = crypto.GeneratePrivateKey()
+		recipient   = crypto.GeneratePrivateKey()
+		coins       = []Coin{{TxHash: util.RandomHash(), OutIndex: 0, Amount: 100}}
+		preimage, h = NewSwapSecret()
+	)
+
+	swapTx, err := CreateSwap(sender, coins, recipient.Public().Address(), 60, h, 10)
+	require.Nil(t, err)
+	assert.True(t, types.VerifyTransaction(swapTx))
+	require.Equal(t, 2, len(swapTx.Outputs))
+	assert.Equal(t, int64(60), swapTx.Outputs[0].Amount)
+	assert.Equal(t, h, swapTx.Outputs[0].Htlc.HashLock)
+	assert.Equal(t, sender.Public().Address().Bytes(), swapTx.Outputs[0].Htlc.RefundAddress)
+	assert.Equal(t, int64(40), swapTx.Outputs[1].Amount)
+
+	_, err = CreateSwap(sender, coins, recipient.Public().Address(), 101, h, 10)
+	assert.NotNil(t, err)
+	_, err = CreateSwap(sender, coins, recipient.Public().Address(), 60, h, types.LockTimeThreshold)
+	assert.NotNil(t, err)
+
+	claimTx, err := ClaimSwap(recipient, swapTx, 0, preimage)
+	require.Nil(t, err)
+	assert.True(t, types.VerifyTransaction(claimTx))
+	assert.Equal(t, preimage, claimTx.Inputs[0].Preimage)
+
+	_, err = ClaimSwap(recipient, swapTx, 0, util.RandomHash())
+	assert.NotNil(t, err)
+	_, err = ClaimSwap(recipient, swapTx, 1, preimage)
+	assert.NotNil(t, err)
+
+	refundTx, err := RefundSwap(sender, swapTx, 0)
+	require.Nil(t, err)
+	assert.True(t, types.VerifyTransaction(refundTx))
+	assert.Equal(t, int64(10), refundTx.LockTime)
+}
+
+func TestSwapKeepsAsset(t *testing.T) {
+	var (
+		sender      = crypto.GeneratePrivateKey()
+		recipient   = crypto.GeneratePrivateKey()
+		coins       = []Coin{{TxHash: util.RandomHash(), OutIndex: 0, Amount: 100}}
+		preimage, h = NewSwapSecret()
+		assetID     = util.RandomHash()
+	)
+
+	swapTx, err := CreateSwap(sender, coins, recipient.Public().Address(), 60, h, 10)
+	require.Nil(t, err)
+	swapTx.Outputs[0].AssetId = assetID
+
+	claimTx, err := ClaimSwap(recipient, swapTx, 0, preimage)
+	require.Nil(t, err)
+	assert.Equal(t, assetID, claimTx.Outputs[0].AssetId)
+
+	refundTx, err := RefundSwap(sender, swapTx, 0)
+	require.Nil(t, err)
+	assert.Equal(t, assetID, refundTx.Outputs[0].AssetId)
+}